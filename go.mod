@@ -2,4 +2,11 @@ module github.com/vikulkhosla/ctoo-golang
 
 go 1.18
 
-require github.com/gorilla/mux v1.8.0
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/gorilla/mux v1.8.0
+	golang.org/x/net v0.23.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/text v0.14.0 // indirect
@@ -0,0 +1,237 @@
+package nicohttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Access log fields that can be selected for the JSONLOG and CUSTOM formats
+const (
+	FieldTime string = "time"
+	FieldRequestID string = "requestID"
+	FieldUser string = "user"
+	FieldRemoteAddr string = "remoteAddr"
+	FieldMethod string = "method"
+	FieldURI string = "uri"
+	FieldProto string = "proto"
+	FieldRoute string = "route"
+	FieldStatus string = "status"
+	FieldContentType string = "contentType"
+	FieldBytesIn string = "bytesIn"
+	FieldBytesOut string = "bytesOut"
+	FieldDuration string = "duration"
+	FieldReferer string = "referer"
+	FieldUserAgent string = "userAgent"
+)
+
+const (
+	combinedLogTimeFormat string = "02/Jan/2006:15:04:05 -0700"
+)
+
+var (
+	allAccessLogFields = []string{FieldTime, FieldRequestID, FieldUser, FieldRemoteAddr, FieldMethod, FieldURI,
+		FieldProto, FieldRoute, FieldStatus, FieldContentType, FieldBytesIn, FieldBytesOut, FieldDuration,
+		FieldReferer, FieldUserAgent}
+	defaultAccessLogExclusions = []string{"^/healthz$", "^/livez$", "^/readyz$", "^/logs", "^/metrics$"}
+)
+
+type accessLogConfig struct {
+	format accessLogFormat
+	fields []string
+	exclusions []*regexp.Regexp
+}
+
+type accessLogRecord struct {
+	start time.Time
+	requestID string
+	user string
+	remoteAddr string
+	method string
+	uri string
+	proto string
+	route string
+	status int
+	contentType string
+	bytesIn int64
+	bytesOut int
+	duration time.Duration
+	referer string
+	userAgent string
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+
+func defaultAccessLogConfig() accessLogConfig {
+	return accessLogConfig{format: DEFAULTLOG, fields: allAccessLogFields, exclusions: compileExclusions(defaultAccessLogExclusions)}
+}
+
+
+func compileExclusions(patterns []string) []*regexp.Regexp {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		res = append(res, regexp.MustCompile(p))
+	}
+	return res
+}
+
+
+func (c *accessLogConfig) excluded(path string) bool {
+	for _, re := range c.exclusions {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+
+// String - the format, with its fields for the JSONLOG and CUSTOM formats
+func (c *accessLogConfig) String() string {
+	if c.format == JSONLOG || c.format == CUSTOM {
+		return fmt.Sprintf("%s(%s)", c.format, strings.Join(c.fields, ","))
+	}
+	return c.format.String()
+}
+
+
+// routeName - name of the mux route matching r, its path template if unnamed
+func routeName(router *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+	if router == nil || !router.Match(r, &match) || match.Route == nil {
+		return ""
+	}
+	if name := match.Route.GetName(); name != "" {
+		return name
+	}
+	t, _ := match.Route.GetPathTemplate()
+	return t
+}
+
+
+// authenticatedUser - the user the auth mediator authenticated, else the one named by the headers
+func authenticatedUser(r *http.Request) string {
+	if user := AuthenticatedUser(r.Context()); user != "" {
+		return user
+	}
+	user := r.Header.Get("X-AUTH-USER")
+	if user == "" || user == "anonymous" {
+		user = r.Header.Get("X-Goog-Authenticated-User-Email")
+		if user == "" {
+			user = r.Header.Get("X-CHARIOT-USER")
+			if user == "" {
+				user = "anonymous"
+			}
+		}
+	}
+	return user
+}
+
+
+func (rec *accessLogRecord) value(field string) interface{} {
+	switch field {
+		case FieldTime:
+			return rec.start.Format(time.RFC3339Nano)
+		case FieldRequestID:
+			return rec.requestID
+		case FieldUser:
+			return rec.user
+		case FieldRemoteAddr:
+			return rec.remoteAddr
+		case FieldMethod:
+			return rec.method
+		case FieldURI:
+			return rec.uri
+		case FieldProto:
+			return rec.proto
+		case FieldRoute:
+			return rec.route
+		case FieldStatus:
+			return rec.status
+		case FieldContentType:
+			return rec.contentType
+		case FieldBytesIn:
+			return rec.bytesIn
+		case FieldBytesOut:
+			return rec.bytesOut
+		case FieldDuration:
+			return rec.duration.String()
+		case FieldReferer:
+			return rec.referer
+		case FieldUserAgent:
+			return rec.userAgent
+		default:
+			return nil
+	}
+}
+
+
+func (c *accessLogConfig) render(rec *accessLogRecord) string {
+	switch c.format {
+		case COMBINED:
+			user := rec.user
+			if user == "anonymous" {
+				user = ""
+			}
+			bytesOut := "-"
+			if rec.bytesOut > 0 {
+				bytesOut = strconv.Itoa(rec.bytesOut)
+			}
+			return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"",
+				hostOnly(rec.remoteAddr), combinedField(user), rec.start.Format(combinedLogTimeFormat), rec.method, rec.uri,
+				rec.proto, rec.status, bytesOut, combinedField(rec.referer), combinedField(rec.userAgent))
+		case JSONLOG:
+			m := make(map[string]interface{}, len(c.fields))
+			for _, f := range c.fields {
+				m[f] = rec.value(f)
+			}
+			js, err := json.Marshal(m)
+			if err != nil {
+				return fmt.Sprintf("Access log JSON error: %s", err)
+			}
+			return string(js)
+		case CUSTOM:
+			kv := make([]string, 0, len(c.fields))
+			for _, f := range c.fields {
+				kv = append(kv, fmt.Sprintf("%s=%v", f, rec.value(f)))
+			}
+			return strings.Join(kv, ", ")
+		default:
+			return fmt.Sprintf("Request: requestID=%s, user=%s, remoteAddr=%s, %s %s ; Response: status=%d, CT=%s, CL=%d, duration=%s",
+				rec.requestID, rec.user, rec.remoteAddr, rec.method, rec.uri, rec.status, rec.contentType, rec.bytesOut, rec.duration)
+	}
+}
+
+
+func hostOnly(remoteAddr string) string {
+	if i := strings.LastIndex(remoteAddr, ":"); i > 0 {
+		return strings.Trim(remoteAddr[:i], "[]")
+	}
+	return remoteAddr
+}
+
+
+// combinedField - the value of a combined log field, - when there is none as in Apache logs
+func combinedField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
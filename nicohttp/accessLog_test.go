@@ -0,0 +1,83 @@
+package nicohttp
+
+import (
+	"flag"
+	"net/http"
+	"testing"
+	"time"
+)
+
+
+func testAccessLogRecord() *accessLogRecord {
+	return &accessLogRecord{
+		start: time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC),
+		requestID: "r1",
+		user: "bob",
+		remoteAddr: "10.1.2.3:5555",
+		method: "GET",
+		uri: "/regions?page=2",
+		proto: "HTTP/1.1",
+		route: "GetRegions",
+		status: 200,
+		bytesOut: 42,
+		duration: 1500 * time.Microsecond,
+		referer: "http://example.com/",
+		userAgent: "curl/7.79",
+	}
+}
+
+
+func TestAccessLogCombined(t *testing.T) {
+	c := accessLogConfig{format: COMBINED}
+	actual := c.render(testAccessLogRecord())
+	expected := `10.1.2.3 - bob [04/Mar/2022:05:06:07 +0000] "GET /regions?page=2 HTTP/1.1" 200 42 "http://example.com/" "curl/7.79"`
+	if actual != expected {
+		t.Fatalf("%s: expected = %s, actual = %s", t.Name(), expected, actual)
+	}
+}
+
+
+func TestAccessLogCombinedMissingFields(t *testing.T) {
+	rec := testAccessLogRecord()
+	rec.user, rec.bytesOut, rec.referer, rec.userAgent = "anonymous", 0, "", ""
+	c := accessLogConfig{format: COMBINED}
+	actual := c.render(rec)
+	expected := `10.1.2.3 - - [04/Mar/2022:05:06:07 +0000] "GET /regions?page=2 HTTP/1.1" 200 - "-" "-"`
+	if actual != expected {
+		t.Fatalf("%s: expected = %s, actual = %s", t.Name(), expected, actual)
+	}
+}
+
+
+func TestAccessLogFormatFlag(t *testing.T) {
+	fs := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	initBaseFlags(fs)
+	fs.Parse([]string{"-accessLogFormat", "COMBINED"})
+	b := GetBuilder().WithDefaults().WithNoMemoryLogger().WithFlagSet(fs)
+	b.flagset["accessLogFormat"] = true
+	validateBaseArgs(b)
+	initBuiltServer(t.Name(), 0, b, &http.Server{})
+	if b.server.accessLog.format != COMBINED || b.Props()[AccessLogFormatKey] != "COMBINED" {
+		t.Fatalf("%s: format %s", t.Name(), b.Props()[AccessLogFormatKey])
+	}
+}
+
+
+func TestAccessLogCustom(t *testing.T) {
+	c := accessLogConfig{format: CUSTOM, fields: []string{FieldRoute, FieldStatus, FieldDuration}}
+	actual := c.render(testAccessLogRecord())
+	expected := "route=GetRegions, status=200, duration=1.5ms"
+	if actual != expected {
+		t.Fatalf("%s: expected = %s, actual = %s", t.Name(), expected, actual)
+	}
+}
+
+
+func TestAccessLogExclusions(t *testing.T) {
+	c := defaultAccessLogConfig()
+	for path, expected := range map[string]bool{"/healthz": true, "/livez": true, "/readyz": true, "/logs/tail/5": true, "/healthzz": false, "/regions": false} {
+		if c.excluded(path) != expected {
+			t.Fatalf("%s: path = %s, expected excluded = %t", t.Name(), path, expected)
+		}
+	}
+}
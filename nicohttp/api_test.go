@@ -28,6 +28,7 @@ func TestGetLogSize0(t *testing.T) {
 	}
 	defer srv.Stop()
 	go srv.Start()
+	<-srv.Ready()
 	resp, err := http.Get(getTarget(p, uriLogSize))
 	if err != nil {
 		t.Fatalf("%s: %t", t.Name(), err)
@@ -54,6 +55,7 @@ func TestGetLogSize1(t *testing.T) {
 	}
 	defer srv.Stop()
 	go srv.Start()
+	<-srv.Ready()
 	http.Get(getTarget(p, uriAPI))
 	resp, err := http.Get(getTarget(p, uriLogSize))
 	if err != nil {
@@ -82,6 +84,7 @@ func TestGenerateAPI1(t *testing.T) {
 	}
 	defer srv.Stop()
 	go srv.Start()
+	<-srv.Ready()
 	resp, err := http.Get(getTarget(p, uriAPI))
 	if err != nil {
 		t.Fatalf("%s: %t", t.Name(), err)
@@ -99,8 +102,8 @@ func TestGenerateAPI1(t *testing.T) {
 	if err != nil {
 		t.Fatalf("%s: %t", t.Name(), err)
 	}
-	expected := []string{"GET   /healthz", "POST   /suspend", "GET   /suspend", "POST   /restart", 
-						"POST   /shutdown", "GET   /api", "GET   /uptime", "GET   /builder",
+	expected := []string{"GET   /healthz", "GET   /livez", "GET   /readyz", "POST   /suspend", "GET   /suspend", "POST   /restart", 
+						"POST   /shutdown", "GET   /api", "GET   /uptime", "GET   /builder", "GET   /metrics", "GET   /breakers",
 						"GET   /logs/head/{entries}", "GET   /logs/tail/{entries}", "GET   /logs/size",
 						"POST   /dumplog",
 					}
@@ -149,6 +152,7 @@ func TestHealthz1(t *testing.T) {
 	}
 	defer srv.Stop()
 	go srv.Start()
+	<-srv.Ready()
 	resp, err := http.Get(getTarget(p, uriHealthz))
 	if err != nil {
 		t.Fatalf("%s: %t", t.Name(), err)
@@ -169,6 +173,7 @@ func TestHealthzAfterSuspend(t *testing.T) {
 	}
 	defer srv.Stop()
 	go srv.Start()
+	<-srv.Ready()
 	resp, err := http.Post(getTarget(p, uriSuspend), "", nil)
 	if err != nil {
 		t.Fatalf("%s: %t", t.Name(), err)
@@ -191,6 +196,7 @@ func TestHealthzFirdtSuspendThenRestart(t *testing.T) {
 	}
 	defer srv.Stop()
 	go srv.Start()
+	<-srv.Ready()
 	resp, err := http.Post(getTarget(p, uriSuspend), "", nil)
 	if err != nil {
 		t.Fatalf("%s: %t", t.Name(), err)
@@ -217,6 +223,7 @@ func TestGetBuilder1(t *testing.T) {
 	}
 	defer srv.Stop()
 	go srv.Start()
+	<-srv.Ready()
 	resp, err := http.Get(getTarget(p, uriBuilder))
 	if err != nil {
 		t.Fatalf("%s: %t", t.Name(), err)
@@ -262,6 +269,7 @@ func TestGenerateAPINoMemoryLogging(t *testing.T) {
 	}
 	defer srv.Stop()
 	go srv.Start()
+	<-srv.Ready()
 	resp, err := http.Get(getTarget(p, uriAPI))
 	if err != nil {
 		t.Fatalf("%s: %t", t.Name(), err)
@@ -279,8 +287,8 @@ func TestGenerateAPINoMemoryLogging(t *testing.T) {
 	if err != nil {
 		t.Fatalf("%s: %t", t.Name(), err)
 	}
-	expected := []string{"GET   /healthz", "POST   /suspend", "GET   /suspend", "POST   /restart", 
-						"POST   /shutdown", "GET   /api", "GET   /uptime", "GET   /builder",
+	expected := []string{"GET   /healthz", "GET   /livez", "GET   /readyz", "POST   /suspend", "GET   /suspend", "POST   /restart", 
+						"POST   /shutdown", "GET   /api", "GET   /uptime", "GET   /builder", "GET   /metrics", "GET   /breakers",
 					}
 	actual, ok := m["base-service"]
 	if !ok {
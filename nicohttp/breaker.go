@@ -0,0 +1,383 @@
+package nicohttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBreakerConsecutiveFailures int = 5
+	defaultBreakerFailureRate float64 = 0.5
+	defaultBreakerMinRequests int = 20
+	defaultBreakerWindow time.Duration = 60 * time.Second
+	defaultBreakerOpenTimeout time.Duration = 30 * time.Second
+	defaultBreakerHalfOpenRequests int = 1
+)
+
+// ErrBreakerOpen - returned without calling the dependency while the breaker is open
+var ErrBreakerOpen = errors.New("circuit breaker is open")
+
+type breakerState int
+const (
+	// BreakerClosed - calls flow, failures are counted
+	BreakerClosed breakerState = iota
+	// BreakerOpen - calls are rejected until the open timeout expires
+	BreakerOpen
+	// BreakerHalfOpen - a limited number of trial calls decide whether to close or reopen
+	BreakerHalfOpen
+)
+
+// BreakerOption - optional thresholds of a CircuitBreaker
+type BreakerOption func(cb *CircuitBreaker)
+
+// CircuitBreaker - stops calling a failing dependency, opening on either too many consecutive
+// failures or a failure rate over the window, and probing it again after the open timeout
+type CircuitBreaker struct {
+	name string
+	critical bool
+	consecutiveFailures int
+	failureRate float64
+	minRequests int
+	window time.Duration
+	openTimeout time.Duration
+	halfOpenRequests int
+
+	mu sync.Mutex
+	state breakerState
+	consecutive int
+	requests int
+	failures int
+	windowStart time.Time
+	openedAt time.Time
+	halfOpenInFlight int
+	halfOpenSuccesses int
+	lastError string
+	rejected int64
+	server *NicoServer
+}
+
+type breakerStatus struct {
+	State string `json:"state"`
+	Critical bool `json:"critical"`
+	Requests int `json:"requests"`
+	Failures int `json:"failures"`
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+	Rejected int64 `json:"rejected"`
+	OpenedAt string `json:"openedAt,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+
+// ConsecutiveFailures - open after n consecutive failures. Default is 5
+func ConsecutiveFailures(n int) BreakerOption {
+	return func(cb *CircuitBreaker) {
+		cb.consecutiveFailures = n
+	}
+}
+
+
+// FailureRate - open when the failure rate over window reaches rate, once at least minRequests
+// calls were made in the window. Default is 50% of at least 20 calls over 60s
+func FailureRate(rate float64, minRequests int, window time.Duration) BreakerOption {
+	return func(cb *CircuitBreaker) {
+		cb.failureRate = rate
+		cb.minRequests = minRequests
+		cb.window = window
+	}
+}
+
+
+// OpenTimeout - time the breaker stays open before allowing trial calls. Default is 30s
+func OpenTimeout(d time.Duration) BreakerOption {
+	return func(cb *CircuitBreaker) {
+		cb.openTimeout = d
+	}
+}
+
+
+// HalfOpenRequests - trial calls that must all succeed to close the breaker. Default is 1
+func HalfOpenRequests(n int) BreakerOption {
+	return func(cb *CircuitBreaker) {
+		cb.halfOpenRequests = n
+	}
+}
+
+
+// Critical - the service is reported unhealthy by /healthz while the breaker is open
+func Critical() BreakerOption {
+	return func(cb *CircuitBreaker) {
+		cb.critical = true
+	}
+}
+
+
+// NewCircuitBreaker - returns a closed breaker. Register it with NicoServer.RegisterBreaker to
+// report it through /breakers and /healthz
+func NewCircuitBreaker(name string, opts ...BreakerOption) (*CircuitBreaker) {
+	cb := &CircuitBreaker{
+		name: name,
+		consecutiveFailures: defaultBreakerConsecutiveFailures,
+		failureRate: defaultBreakerFailureRate,
+		minRequests: defaultBreakerMinRequests,
+		window: defaultBreakerWindow,
+		openTimeout: defaultBreakerOpenTimeout,
+		halfOpenRequests: defaultBreakerHalfOpenRequests,
+		windowStart: time.Now(),
+	}
+	for _, opt := range opts {
+		opt(cb)
+	}
+	return cb
+}
+
+
+// Name - name of the breaker
+func (cb *CircuitBreaker) Name() string {
+	return cb.name
+}
+
+
+// State - current state of the breaker
+func (cb *CircuitBreaker) State() breakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.advance(time.Now())
+	return cb.state
+}
+
+
+// Execute - calls f unless the breaker is open, recording the outcome
+func (cb *CircuitBreaker) Execute(f func() error) error {
+	if err := cb.Allow(); err != nil {
+		return err
+	}
+	err := f()
+	cb.Record(err)
+	return err
+}
+
+
+// Allow - ErrBreakerOpen if a call must not be made now. Every allowed call must be followed by Record
+func (cb *CircuitBreaker) Allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.advance(time.Now())
+	switch cb.state {
+		case BreakerOpen:
+			atomic.AddInt64(&cb.rejected, 1)
+			return ErrBreakerOpen
+		case BreakerHalfOpen:
+			if cb.halfOpenInFlight >= cb.halfOpenRequests {
+				atomic.AddInt64(&cb.rejected, 1)
+				return ErrBreakerOpen
+			}
+			cb.halfOpenInFlight++
+	}
+	return nil
+}
+
+
+// Record - records the outcome of an allowed call, nil for success
+func (cb *CircuitBreaker) Record(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	now := time.Now()
+	cb.advance(now)
+
+	if cb.state == BreakerHalfOpen {
+		cb.halfOpenInFlight--
+		if err != nil {
+			cb.lastError = err.Error()
+			cb.trip(now)
+			return
+		}
+		cb.halfOpenSuccesses++
+		if cb.halfOpenSuccesses >= cb.halfOpenRequests {
+			cb.reset(now, BreakerClosed)
+		}
+		return
+	}
+	if cb.state != BreakerClosed {
+		return
+	}
+	cb.requests++
+	if err == nil {
+		cb.consecutive = 0
+		return
+	}
+	cb.failures++
+	cb.consecutive++
+	cb.lastError = err.Error()
+	if cb.consecutiveFailures > 0 && cb.consecutive >= cb.consecutiveFailures {
+		cb.trip(now)
+		return
+	}
+	if cb.failureRate > 0 && cb.requests >= cb.minRequests && float64(cb.failures)/float64(cb.requests) >= cb.failureRate {
+		cb.trip(now)
+	}
+}
+
+
+/* advance - time driven transitions: open to half open, and rolling the closed window */
+func (cb *CircuitBreaker) advance(now time.Time) {
+	switch cb.state {
+		case BreakerOpen:
+			if now.Sub(cb.openedAt) >= cb.openTimeout {
+				cb.reset(now, BreakerHalfOpen)
+				logBreakerTransition(cb, BreakerOpen)
+			}
+		case BreakerClosed:
+			if cb.window > 0 && now.Sub(cb.windowStart) >= cb.window {
+				cb.requests = 0
+				cb.failures = 0
+				cb.windowStart = now
+			}
+	}
+}
+
+
+func (cb *CircuitBreaker) trip(now time.Time) {
+	from := cb.state
+	cb.reset(now, BreakerOpen)
+	cb.openedAt = now
+	logBreakerTransition(cb, from)
+}
+
+
+func (cb *CircuitBreaker) reset(now time.Time, state breakerState) {
+	from := cb.state
+	cb.state = state
+	cb.consecutive = 0
+	cb.requests = 0
+	cb.failures = 0
+	cb.windowStart = now
+	cb.halfOpenInFlight = 0
+	cb.halfOpenSuccesses = 0
+	if state == BreakerClosed && from == BreakerHalfOpen {
+		logBreakerTransition(cb, from)
+	}
+}
+
+
+func logBreakerTransition(cb *CircuitBreaker, from breakerState) {
+	/* the breaker lock is held, so the memory logger is not waited for */
+	msg := fmt.Sprintf("Circuit breaker %s: %s -> %s, lastError=%s", cb.name, from, cb.state, cb.lastError)
+	if cb.server != nil {
+		go emitLogEntry(cb.server, msg)
+	}
+}
+
+
+func (cb *CircuitBreaker) status() breakerStatus {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.advance(time.Now())
+	s := breakerStatus{
+		State: cb.state.String(),
+		Critical: cb.critical,
+		Requests: cb.requests,
+		Failures: cb.failures,
+		ConsecutiveFailures: cb.consecutive,
+		Rejected: atomic.LoadInt64(&cb.rejected),
+		LastError: cb.lastError,
+	}
+	if cb.state != BreakerClosed {
+		s.OpenedAt = cb.openedAt.Format(time.RFC3339)
+	}
+	return s
+}
+
+
+/**************** Client integration **********************/
+
+// ClientBreaker - calls through the client are guarded by cb. Network errors and 5xx responses
+// count as failures, and calls are rejected with ErrBreakerOpen while it is open
+func ClientBreaker(cb *CircuitBreaker) ClientOption {
+	return func(c *clientConfig) {
+		c.breaker = cb
+	}
+}
+
+
+func breakerOutcome(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+
+/**************** Server registry **********************/
+
+// RegisterBreaker - reports cb through /breakers, and through /healthz if it is critical
+func (h *NicoServer) RegisterBreaker(cb *CircuitBreaker) {
+	h.breakersLock.Lock()
+	defer h.breakersLock.Unlock()
+	if h.breakers == nil {
+		h.breakers = make(map[string]*CircuitBreaker)
+	}
+	h.breakers[cb.name] = cb
+	cb.logTo(h)
+}
+
+
+/* logTo - transitions are logged to the memory log of the first server using the breaker */
+func (cb *CircuitBreaker) logTo(server *NicoServer) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.server == nil {
+		cb.server = server
+	}
+}
+
+
+func registeredBreakers(server *NicoServer) []*CircuitBreaker {
+	server.breakersLock.Lock()
+	defer server.breakersLock.Unlock()
+	names := make([]string, 0, len(server.breakers))
+	for n := range server.breakers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	cbs := make([]*CircuitBreaker, 0, len(names))
+	for _, n := range names {
+		cbs = append(cbs, server.breakers[n])
+	}
+	return cbs
+}
+
+
+// criticalBreakerOpen - true if a critical breaker is open. A half-open one is not, so that its
+// trial calls can reach the dependency and close it
+func criticalBreakerOpen(server *NicoServer) bool {
+	for _, cb := range registeredBreakers(server) {
+		if cb.critical && cb.State() == BreakerOpen {
+			return true
+		}
+	}
+	return false
+}
+
+
+func (h *NicoServer) getBreakers(w http.ResponseWriter, r *http.Request) {
+	m := make(map[string]breakerStatus)
+	for _, cb := range registeredBreakers(h) {
+		m[cb.name] = cb.status()
+	}
+	js, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		WriteProblem(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,125 @@
+package nicohttp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	cb := NewCircuitBreaker("db", ConsecutiveFailures(3), OpenTimeout(50*time.Millisecond))
+	boom := errors.New("boom")
+	for i := 0; i < 3; i++ {
+		if err := cb.Execute(func() error { return boom }); err != boom {
+			t.Fatalf("%s: expected the call error, actual = %v", t.Name(), err)
+		}
+	}
+	if cb.State() != BreakerOpen {
+		t.Fatalf("%s: expected open, actual = %s", t.Name(), cb.State())
+	}
+	called := false
+	if err := cb.Execute(func() error { called = true; return nil }); err != ErrBreakerOpen || called {
+		t.Fatalf("%s: open breaker must reject calls, err = %v", t.Name(), err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if cb.State() != BreakerHalfOpen {
+		t.Fatalf("%s: expected half-open, actual = %s", t.Name(), cb.State())
+	}
+	if err := cb.Execute(func() error { return boom }); err != boom || cb.State() != BreakerOpen {
+		t.Fatalf("%s: failed trial call must reopen, state = %s", t.Name(), cb.State())
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := cb.Execute(func() error { return nil }); err != nil || cb.State() != BreakerClosed {
+		t.Fatalf("%s: successful trial call must close, state = %s", t.Name(), cb.State())
+	}
+}
+
+
+func TestBreakerFailureRate(t *testing.T) {
+	cb := NewCircuitBreaker("api", ConsecutiveFailures(0), FailureRate(0.5, 10, time.Minute))
+	for i := 0; i < 9; i++ {
+		var err error
+		if i%2 == 0 {
+			err = errors.New("boom")
+		}
+		cb.Execute(func() error { return err })
+	}
+	if cb.State() != BreakerClosed {
+		t.Fatalf("%s: must stay closed below the minimum requests", t.Name())
+	}
+	cb.Execute(func() error { return errors.New("boom") })
+	if cb.State() != BreakerOpen {
+		t.Fatalf("%s: expected open at 60%% failures, actual = %s", t.Name(), cb.State())
+	}
+}
+
+
+func TestClientBreaker(t *testing.T) {
+	b := GetBuilder().WithDefaults()
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	cb := NewCircuitBreaker("upstream", ConsecutiveFailures(2), Critical())
+	b.server.RegisterBreaker(cb)
+	c := b.server.NewClient(ClientRetries(0, 0, 0), ClientBreaker(cb))
+	for i := 0; i < 2; i++ {
+		resp, err := c.Get(upstream.URL)
+		if err != nil {
+			t.Fatalf("%s: %s", t.Name(), err)
+		}
+		resp.Body.Close()
+	}
+	if _, err := c.Get(upstream.URL); !errors.Is(err, ErrBreakerOpen) || calls != 2 {
+		t.Fatalf("%s: expected ErrBreakerOpen after 2 calls, err = %v, calls = %d", t.Name(), err, calls)
+	}
+
+	rec := httptest.NewRecorder()
+	b.server.getBreakers(rec, httptest.NewRequest(http.MethodGet, "/breakers", nil))
+	var m map[string]breakerStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &m); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if s := m["upstream"]; s.State != "open" || !s.Critical || s.Rejected != 1 {
+		t.Fatalf("%s: unexpected status %+v", t.Name(), s)
+	}
+	b.server.healthy = 1
+	rec = httptest.NewRecorder()
+	b.server.healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("%s: open critical breaker must fail /healthz, actual = %d", t.Name(), rec.Code)
+	}
+}
+
+
+func TestCriticalBreakerHalfOpen(t *testing.T) {
+	b := GetBuilder().WithDefaults()
+	cb := NewCircuitBreaker("db", ConsecutiveFailures(1), OpenTimeout(50*time.Millisecond), Critical())
+	b.server.RegisterBreaker(cb)
+	b.server.healthy = 1
+	healthz := func() int {
+		rec := httptest.NewRecorder()
+		b.server.healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return rec.Code
+	}
+
+	cb.Execute(func() error { return errors.New("boom") })
+	if code := healthz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("%s: open critical breaker must fail /healthz, actual = %d", t.Name(), code)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if cb.State() != BreakerHalfOpen {
+		t.Fatalf("%s: expected half-open, actual = %s", t.Name(), cb.State())
+	}
+	if code := healthz(); code != http.StatusOK {
+		t.Fatalf("%s: half-open critical breaker must pass /healthz, actual = %d", t.Name(), code)
+	}
+}
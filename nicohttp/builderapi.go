@@ -9,16 +9,11 @@ import (
 	"time"
 	"flag"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
 
-var (
-	builder *NicoBuilder
-	mutex = &sync.Mutex{}
-	handlerChain = [8]func(http.Handler) http.Handler{}
-)
-
 const (
 	// ListenPortKey ...
 	ListenPortKey string = "listenPort"
@@ -44,6 +39,82 @@ const (
 	CustomPostMediatorKey string = "CustomPostMediator"
 	// MemoryLoggerQoSKey ...
 	MemoryLoggerQoSKey string = "MemoryLoggerQoS"
+	// LogSpoolKey ...
+	LogSpoolKey string = "LogSpool"
+	// LogSpoolLimitKey ...
+	LogSpoolLimitKey string = "LogSpoolLimit (bytes)"
+	// LogFlushIntervalKey ...
+	LogFlushIntervalKey string = "logFlushInterval (secs)"
+	// LogFlushBytesKey ...
+	LogFlushBytesKey string = "logFlushBytes"
+	// RedactionKey ...
+	RedactionKey string = "Redaction"
+	// AccessLogFormatKey ...
+	AccessLogFormatKey string = "AccessLogFormat"
+	// AccessLogExclusionsKey ...
+	AccessLogExclusionsKey string = "AccessLogExclusions"
+	// TraceExporterKey ...
+	TraceExporterKey string = "TraceExporter"
+	// ReadinessChecksKey ...
+	ReadinessChecksKey string = "ReadinessChecks"
+	// LivenessChecksKey ...
+	LivenessChecksKey string = "LivenessChecks"
+	// PreStopDelayKey ...
+	PreStopDelayKey string = "preStopDelay (secs)"
+	// ShutdownSignalsKey ...
+	ShutdownSignalsKey string = "ShutdownSignals"
+	// LifecycleHooksKey ...
+	LifecycleHooksKey string = "LifecycleHooks"
+	// PipelineKey ...
+	PipelineKey string = "Pipeline"
+	// RouteGroupsKey ...
+	RouteGroupsKey string = "RouteGroups"
+	// PanicReporterKey ...
+	PanicReporterKey string = "PanicReporter"
+	// TimeoutResponseKey ...
+	TimeoutResponseKey string = "timeoutResponse (status)"
+	// ReadTimeoutKey ...
+	ReadTimeoutKey string = "readTimeout (secs)"
+	// ReadHeaderTimeoutKey ...
+	ReadHeaderTimeoutKey string = "readHeaderTimeout (secs)"
+	// WriteTimeoutKey ...
+	WriteTimeoutKey string = "writeTimeout (secs)"
+	// IdleTimeoutKey ...
+	IdleTimeoutKey string = "idleTimeout (secs)"
+	// MaxHeaderBytesKey ...
+	MaxHeaderBytesKey string = "maxHeaderBytes"
+	// MaxBodyBytesKey ...
+	MaxBodyBytesKey string = "maxBodyBytes"
+	// KeepAlivesKey ...
+	KeepAlivesKey string = "keepAlives"
+	// H2CKey ...
+	H2CKey string = "h2c"
+	// TLSCertKey ...
+	TLSCertKey string = "tlsCert"
+	// TLSKeyKey ...
+	TLSKeyKey string = "tlsKey"
+	// TLSMinVersionKey ...
+	TLSMinVersionKey string = "tlsMinVersion"
+	// TLSCipherSuitesKey ...
+	TLSCipherSuitesKey string = "tlsCipherSuites"
+	// TLSClientCAKey ...
+	TLSClientCAKey string = "tlsClientCA"
+	// TLSClientAuthKey ...
+	TLSClientAuthKey string = "tlsClientAuth"
+	// BindAddressKey ...
+	BindAddressKey string = "bindAddress"
+	// UnixSocketKey ...
+	UnixSocketKey string = "unixSocket"
+	// SocketActivationKey ...
+	SocketActivationKey string = "socketActivation"
+	// UpgradeTimeoutKey ...
+	UpgradeTimeoutKey string = "upgradeTimeout"
+	// ConfigFileKey ...
+	ConfigFileKey string = "configFile"
+	// EnvPrefixKey ...
+	EnvPrefixKey string = "envPrefix"
+	// ConfigSourcesKey ...
+	ConfigSourcesKey string = "ConfigSources"
 )
 
 type  authNStrategy int
@@ -58,6 +129,8 @@ const (
 	LDAP
 	// NOAUTH - No Enforcement
 	NOAUTH 
+	// MTLS - verified TLS client certificate, its subject is the authenticated user
+	MTLS
  )
 
  type  memoryLoggerType int
@@ -68,6 +141,18 @@ const (
 	EntryBound
  )
 
+type accessLogFormat int
+const (
+	// DEFAULTLOG - nicohttp access log line
+	DEFAULTLOG accessLogFormat = iota
+	// COMBINED - Apache combined log format
+	COMBINED
+	// JSONLOG - one JSON object per request with the selected fields
+	JSONLOG
+	// CUSTOM - the selected fields as key=value pairs
+	CUSTOM
+)
+
 type logSink int
 const (
 	//FILE sink
@@ -84,21 +169,43 @@ type NicoBuilder struct {
 	baseFlags bool
 	extendedFlags int
 	extendedRequiredFlags int
+	requiredBaseArgs int
 	disabledMemoryLogs bool
+	mu sync.Mutex
+	chain []stage
+	err error
+	flags *flag.FlagSet
+	flagset map[string]bool
+	durations map[string]time.Duration
+	stdLog bool
 }
 
 
 
-// GetBuilder - returns a new Builder or existing Builder. 
+// GetBuilder - returns a new Builder. Each builder owns its server, middleware chain, flags and
+// logger, so several servers (e.g. public and internal APIs) can be built and run in one process
 func GetBuilder() (*NicoBuilder) {
-	defer mutex.Unlock()
-	mutex.Lock()
-	builder = &NicoBuilder{}
-	builder.props = defaultProps()
-	builder.server = &NicoServer{}
-	builder.server.builder = builder
-	builder.disabledMemoryLogs = false
-	return builder
+	b := &NicoBuilder{flags: flag.CommandLine, flagset: make(map[string]bool),
+		durations: make(map[string]time.Duration), stdLog: true}
+	b.props = defaultProps()
+	b.server = &NicoServer{}
+	b.server.builder = b
+	b.server.accessLog = defaultAccessLogConfig()
+	initServerMetrics(b.server)
+	b.server.tracer = newTracer("", nil)
+	b.server.logger = log.New(os.Stdout, "", log.LstdFlags)
+	b.server.timeoutStatus = defaultTimeoutStatus
+	b.server.timeoutDetail = defaultTimeoutDetail
+	b.server.signals = defaultShutdownSignals
+	b.server.interruptChannel = make(chan os.Signal, 1)
+	b.server.serveErr = make(chan error, 1)
+	b.server.ready = make(chan struct{})
+	b.server.stopping = make(chan struct{})
+	b.server.upgradeSignal = make(chan os.Signal, 1)
+	b.server.upgraded = make(chan struct{})
+	b.disabledMemoryLogs = false
+	b.initDefaultHandlerChain()
+	return b
 }
 
 
@@ -107,16 +214,38 @@ func (b *NicoBuilder) Props() (map[string]interface{}) {
 	return b.props
 }
 
+// WithFlagSet - define and parse the builder's flags on fs instead of the command line flags,
+// e.g. to give a second server in the process its own flags. Builders sharing a flag set share
+// the base flags, and must define their flags before the first of them is created
+func (b *NicoBuilder) WithFlagSet(fs *flag.FlagSet) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.flags = fs
+	return b
+}
+
+
+// WithoutStdLog - leave the output of the standard log package alone. Log entries of the service
+// then go through NicoServer.Logger() or Logf
+func (b *NicoBuilder) WithoutStdLog() (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.stdLog = false
+	return b
+}
+
+
 // WithBaseFlags - turn on base flags
 func (b *NicoBuilder) WithBaseFlags() (*NicoBuilder) {
 	b.baseFlags = true
+	initConfigFlag(b.flags)
    return b
 }
 
 
 // WithStringFlag - additional flag
 func (b *NicoBuilder) WithStringFlag(arg, defaultVal, description string, required bool) (*NicoBuilder, *string) {
-	 a := flag.String(arg, defaultVal, description)
+	 a := b.flags.String(arg, defaultVal, description)
 	 if (required) {
 	 	b.extendedRequiredFlags++
 	 }
@@ -127,7 +256,7 @@ func (b *NicoBuilder) WithStringFlag(arg, defaultVal, description string, requir
 
 // WithIntFlag - additional flag
 func (b *NicoBuilder) WithIntFlag(arg string, defaultVal int, description string, required bool) (*NicoBuilder, *int) {
-	a := flag.Int(arg, defaultVal, description)
+	a := b.flags.Int(arg, defaultVal, description)
 	if (required) {
 		b.extendedRequiredFlags++
 	}
@@ -138,7 +267,7 @@ func (b *NicoBuilder) WithIntFlag(arg string, defaultVal int, description string
 
 // WithDurationFlag - additional flag
 func (b *NicoBuilder) WithDurationFlag(argptr *time.Duration, arg string, defaultVal time.Duration, description string, required bool) (*NicoBuilder) {
-	flag.DurationVar(argptr, arg, defaultVal, description)
+	b.flags.DurationVar(argptr, arg, defaultVal, description)
 	if (required) {
 		b.extendedRequiredFlags++
 	}
@@ -149,7 +278,7 @@ func (b *NicoBuilder) WithDurationFlag(argptr *time.Duration, arg string, defaul
 
 // WithBoolFlag - additional flag
 func (b *NicoBuilder) WithBoolFlag(arg string, defaultVal bool, description string, required bool) (*NicoBuilder, *bool) {
-	a := flag.Bool(arg, defaultVal, description)
+	a := b.flags.Bool(arg, defaultVal, description)
 	if (required) {
 		b.extendedRequiredFlags++
 	}
@@ -161,15 +290,15 @@ func (b *NicoBuilder) WithBoolFlag(arg string, defaultVal bool, description stri
 // WithProperties - require custom HTTPServer to support memory based logs
 // accessible through REST API
 func (b *NicoBuilder) WithProperties(m map[string]interface{}) (*NicoBuilder) {
-	defer mutex.Unlock()
-	mutex.Lock()
+	defer b.mu.Unlock()
+	b.mu.Lock()
 
 	for allowedKey := range b.props {
 		if v, ok := m[allowedKey]; ok {
 			b.props[allowedKey] = v
 		}
 	}
-	initDefaultHandlerChain()
+	b.initDefaultHandlerChain()
 	return b
 }
 
@@ -177,30 +306,73 @@ func (b *NicoBuilder) WithProperties(m map[string]interface{}) (*NicoBuilder) {
 // WithDefaults - require custom HTTPServer to support memory based logs
 // accessible through REST API
 func (b *NicoBuilder) WithDefaults() (*NicoBuilder) {
-	defer mutex.Unlock()
-	mutex.Lock()
-	initDefaultHandlerChain()
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.initDefaultHandlerChain()
 	return b
 }
 
 
+// MemoryLoggerOption - additional QoS for the memory logger. The memory log is persisted to the
+// sink as soon as any one of the QoS (entries, bytes or time) is met
+type MemoryLoggerOption func(b *NicoBuilder)
+
+// FlushInterval - persist the memory log at least every d, even if no other QoS has been met
+func FlushInterval(d time.Duration) MemoryLoggerOption {
+	return func(b *NicoBuilder) {
+		b.setDuration(LogFlushIntervalKey, d)
+	}
+}
+
+// FlushBytes - persist the memory log once the logged messages exceed n bytes
+func FlushBytes(n int) MemoryLoggerOption {
+	return func(b *NicoBuilder) {
+		b.props[LogFlushBytesKey] = n
+	}
+}
+
+
+// setDuration - keeps d for the server, and its whole seconds in the props for display
+func (b *NicoBuilder) setDuration(key string, d time.Duration) {
+	b.durations[key] = d
+	b.props[key] = d / time.Second
+}
+
+
+// duration - the duration of a prop as set by setDuration, or the props value in seconds if the
+// props were changed since, e.g. by WithProperties
+func (b *NicoBuilder) duration(key string) time.Duration {
+	if d, ok := b.durations[key]; ok && b.props[key] == d / time.Second {
+		return d
+	}
+	return (b.props[key]).(time.Duration) * time.Second
+}
+
+
 // WithMemoryLogger - require custom HTTPServer to support memory based logs
-// accessible through REST API
-func (b *NicoBuilder) WithMemoryLogger(lt memoryLoggerType, size int) (*NicoBuilder) {
-	defer mutex.Unlock()
-	mutex.Lock()
-	handlerChain[memoryLoggerMediatorPos]= memoryPostLoggingMediator
+// accessible through REST API. size is the number of entries for an EntryBound logger and
+// the number of bytes for a MemoryBound logger
+func (b *NicoBuilder) WithMemoryLogger(lt memoryLoggerType, size int, opts ...MemoryLoggerOption) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.setStage(LoggingStage, b.server.memoryPostLoggingMediator)
 	b.props[MemoryLoggerTypeKey] = lt
 	b.props[MemoryLoggerQoSKey] = size
+	if lt == MemoryBound {
+		b.props[LogFlushBytesKey] = size
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
 	return b
 }
 
 
 // WithNoMemoryLogger - require custom HTTPServer to not support memory based logs
 func (b *NicoBuilder) WithNoMemoryLogger() (*NicoBuilder) {
-	defer mutex.Unlock()
-	mutex.Lock()
-	handlerChain[memoryLoggerMediatorPos]= noopHandler
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.turnOffStage(LoggingStage)
 	b.props[MemoryLoggerTypeKey] = "None"
 	b.props[LogSinkKey] = "None"
 	b.props[MemoryLoggerQoSKey] = 0
@@ -209,22 +381,81 @@ func (b *NicoBuilder) WithNoMemoryLogger() (*NicoBuilder) {
 }
 
 
-// WithTimeoutHandler - require custom HTTPServer to timeout request if upstream
-// handlers not responsive. Return 503
-func (b *NicoBuilder) WithTimeoutHandler(d time.Duration) (*NicoBuilder) {
-	defer mutex.Unlock()
-	mutex.Lock()
-	handlerChain[timeoutHandlerPos] = timeoutMediator
-	b.props[HandlerTimeoutKey] = d
+// WithLogSpool - require custom HTTPServer to append every memory log entry to a write-ahead
+// spool file in dir as it arrives. Entries left unflushed by a crash are recovered and delivered
+// to the log sink on the next Start(). An empty dir uses the log file directory
+func (b *NicoBuilder) WithLogSpool(dir string) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.props[LogSpoolKey] = dir
+	return b
+}
+
+
+// WithLogSpoolLimit - maximum size of the spool, 64MB by default, 0 for no limit. While the sink
+// fails and the spool is full, new entries are only kept in the memory log and counted as dropped
+func (b *NicoBuilder) WithLogSpoolLimit(maxBytes int64) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.props[LogSpoolLimitKey] = maxBytes
+	return b
+}
+
+
+// WithRedactor - require custom HTTPServer to redact sensitive data (query parameters, headers,
+// tokens, ...) from access and application logs before they enter the memory log or any sink
+func (b *NicoBuilder) WithRedactor(rd *Redactor) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.server.redactor = rd
+	b.props[RedactionKey] = rd.String()
+	return b
+}
+
+
+// WithAccessLogFormat - require custom HTTPServer to write access log entries in the given format.
+// fields selects the access log fields (FieldXXX) for the JSONLOG and CUSTOM formats, all fields
+// are used if none are given
+func (b *NicoBuilder) WithAccessLogFormat(format accessLogFormat, fields ...string) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.server.accessLog.format = format
+	if len(fields) > 0 {
+		b.server.accessLog.fields = fields
+	}
+	b.props[AccessLogFormatKey] = b.server.accessLog.String()
+	return b
+}
+
+
+// WithAccessLogExclusions - require custom HTTPServer to skip access log entries for request paths
+// matching any of the regular expressions. Replaces the default exclusions (/healthz and /logs)
+func (b *NicoBuilder) WithAccessLogExclusions(patterns ...string) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.server.accessLog.exclusions = compileExclusions(patterns)
+	b.props[AccessLogExclusionsKey] = strings.Join(patterns, ",")
 	return b
 }
 
 
 // WithTracing - require custom HTTPServer to introduce a unique RequestID for all HTTP calls
 func (b *NicoBuilder) WithTracing() (*NicoBuilder) {
-	defer mutex.Unlock()
-	mutex.Lock()
-	handlerChain[tracingMediatorPos] = tracingMediator
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.setStage(TracingStage, b.server.tracingMediator)
+	return b
+}
+
+
+// WithTraceExporter - require custom HTTPServer to trace all HTTP calls, propagating W3C trace
+// context, and export the spans through the exporter (e.g. NewOTLPHTTPExporter)
+func (b *NicoBuilder) WithTraceExporter(exporter SpanExporter) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.setStage(TracingStage, b.server.tracingMediator)
+	b.server.tracer.exporter = exporter
+	b.props[TraceExporterKey] = fmt.Sprintf("%T", exporter)
 	return b
 }
 
@@ -233,52 +464,71 @@ func (b *NicoBuilder) WithTracing() (*NicoBuilder) {
 // all URI, based on the provided authentication scheme. Some authn schemes will require
 // a config as a Json object
 func (b *NicoBuilder) WithAuthNMediator(strategy authNStrategy, config string) (*NicoBuilder) {
-	defer mutex.Unlock()
-	mutex.Lock()
+	defer b.mu.Unlock()
+	b.mu.Lock()
 	b.props[AuthStrategyKey] = strategy
 	switch (strategy) {
 		case JWTRSA :
-			handlerChain[authStrategyMediatorPos] = rsaJWTMediator
+			b.setStage(AuthStage, rsaJWTMediator)
 		case JWTHMAC :
-			handlerChain[authStrategyMediatorPos] = hmacJWTMediator
+			b.setStage(AuthStage, hmacJWTMediator)
 		case LDAP :
-			handlerChain[authStrategyMediatorPos] = ldapMediator
+			b.setStage(AuthStage, ldapMediator)
 		case BASIC :
-			handlerChain[authStrategyMediatorPos] = httpBasicAuthMediator
+			b.setStage(AuthStage, httpBasicAuthMediator)
 		case NOAUTH :
-			handlerChain[authStrategyMediatorPos] = noAuthMediator
+			b.setStage(AuthStage, noAuthMediator)
+		case MTLS :
+			b.setStage(AuthStage, mtlsMediator)
 		default: 
-			panic(fmt.Sprintf("Unsupported auth strategy %s\n", string(authNStrategy(strategy))))
+			panic(fmt.Sprintf("Unsupported auth strategy %d\n", strategy))
 	}
 	return b
 }
 
 
-// WithCustomPreMediator - require custom HTTP Server to inject custom HTTP Handler as the first
-// handler in the handler chain
+// WithCustomPreMediator - require custom HTTP Server to inject custom HTTP Handler as the last
+// handler in the handler chain, right before the route handler, replacing the previous custom pre
+// mediator
 func (b *NicoBuilder) WithCustomPreMediator(name string, f func(next http.Handler) http.Handler) (*NicoBuilder) {
-	defer mutex.Unlock()
-	mutex.Lock()
-	handlerChain[customPreMediatorPos] = f
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	i := b.stageIndex(b.props[CustomPreMediatorKey].(string))
+	if b.stageTaken(name, i) {
+		return b
+	}
+	if i >= 0 {
+		b.chain = append(b.chain[:i], b.chain[i+1:]...)
+	}
+	b.chain = append(b.chain, stage{name: name, mediator: f})
 	b.props[CustomPreMediatorKey] = name
+	b.updatePipelineProps()
 	return b
 }
 
 
-// WithCustomPostMediator - require custom HTTP Server to inject custom HTTP Handler as the last
-// handler in the handler chain
+// WithCustomPostMediator - require custom HTTP Server to inject custom HTTP Handler as the first
+// (outermost) handler in the handler chain, replacing the previous custom post mediator
 func (b *NicoBuilder) WithCustomPostMediator(name string, f func(next http.Handler) http.Handler) (*NicoBuilder) {
-	defer mutex.Unlock()
-	mutex.Lock()
-	handlerChain[customPostMediatorPos] = f
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	i := b.stageIndex(b.props[CustomPostMediatorKey].(string))
+	if b.stageTaken(name, i) {
+		return b
+	}
+	if i >= 0 {
+		b.chain = append(b.chain[:i], b.chain[i+1:]...)
+	}
+	b.chain = append([]stage{{name: name, mediator: f}}, b.chain...)
 	b.props[CustomPostMediatorKey] = name
+	b.updatePipelineProps()
 	return b
 }
 
 // WithLogSink - use specified log sink for batch writes on memory overflow
 func (b *NicoBuilder) WithLogSink(sink logSink) (*NicoBuilder) {
-	defer mutex.Unlock()
-	mutex.Lock()
+	defer b.mu.Unlock()
+	b.mu.Lock()
 	b.props[LogSinkKey] = sink.String()
 	return b
 }
@@ -287,46 +537,66 @@ func (b *NicoBuilder) WithLogSink(sink logSink) (*NicoBuilder) {
 // Create the custom HTTPServer after all build optionality has been specified
 func (b *NicoBuilder) Create(svcName string, port uint32) (*NicoServer, error) {
 	fmt.Printf("Creating nicoHttp Server .......\n\n")
-	defer mutex.Unlock()
-	mutex.Lock()
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	if b.err != nil {
+		return nil, b.err
+	}
 	if b.baseFlags {
-		requiredBaseArgs = 1 //svcName
-		initBaseFlags()
+		b.requiredBaseArgs = 1 //svcName
+		initBaseFlags(b.flags)
 	}
 	if (b.extendedFlags > 0) || b.baseFlags {
-		flag.Parse()
-		flag.Visit(func(f *flag.Flag) { flagset[f.Name] = true })
-		validateRequiredArgs()
-		validateBaseArgs()
+		initConfigFlag(b.flags)
+		if !b.flags.Parsed() {
+			b.flags.Parse(os.Args[1:])
+		}
+		b.flags.Visit(func(f *flag.Flag) { b.flagset[f.Name] = true })
+		if err := applyConfig(b, svcName); err != nil {
+			return nil, err
+		}
+		validateRequiredArgs(b)
+		validateBaseArgs(b)
 		//updateBuilderProperties()
+	} else if err := checkConfigWithoutFlags(b); err != nil {
+		return nil, err
 	}
 
 	b.server.httpRouter = mux.NewRouter()
+	b.server.httpRouter.NotFoundHandler = notFoundHandler()
+	b.server.httpRouter.MethodNotAllowedHandler = methodNotAllowedHandler()
+	configureUpgrade(b)
 	configureNonFuncRoutes(b)
 
 	/* inject memory logger for regular log output, mux logging already intercepted */
-	if (!b.disabledMemoryLogs) {
-		mlw := newLogWriter (os.Stdout)
-		log.SetOutput(mlw)
+	if (!b.disabledMemoryLogs || b.server.redactor != nil) {
+		b.server.logWriter = newLogWriter(os.Stdout, b.server)
+		b.server.logger.SetOutput(b.server.logWriter)
+		if b.stdLog {
+			log.SetOutput(b.server.logWriter)
+		}
 	}
-	if flag.Lookup("listenPort") != nil {
-		p, err := strconv.Atoi(flag.Lookup("listenPort").Value.String())
+	if b.flags.Lookup("listenPort") != nil {
+		p, err := strconv.Atoi(b.flags.Lookup("listenPort").Value.String())
 		if err != nil {
 			panic(err)
 		}
 		port = uint32(p)
 	}
 
-	addr := fmt.Sprintf("0.0.0.0:%d", port)
 	s := &http.Server{
-		Addr:         addr,
-		WriteTimeout: time.Second * 60,
-		ReadTimeout:  time.Second * 60,
-		IdleTimeout:  time.Second * 60,
-		Handler:      rootHandler((b.server.httpRouter)),
+		Handler:      b.rootHandler(b.server.httpRouter),
+		ErrorLog:     b.server.logger,
 	}
 
 	initBuiltServer(svcName, port, b, s)
+	configureListener(b, s, port)
+	if err := configureHTTPServer(b, s); err != nil {
+		return nil, err
+	}
+	if err := configureTLS(b, s); err != nil {
+		return nil, err
+	}
 	return b.server, nil
 }
 
@@ -338,9 +608,11 @@ func noopHandler(next http.Handler) http.Handler {
 	})
 }
 
-func rootHandler(next http.Handler) http.Handler {
-	return handlerChain[0](handlerChain[1](handlerChain[2](handlerChain[3](handlerChain[4](handlerChain[5](handlerChain[6](
-		(next))))))))
+func (b *NicoBuilder) rootHandler(next http.Handler) http.Handler {
+	chain := b.server.panicFlushMediator(b.wrap(next))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chain.ServeHTTP(w, r.WithContext(contextWithServer(r.Context(), b.server)))
+	})
 }
 
 
@@ -358,34 +630,47 @@ func defaultProps() (map[string]interface{}) {
 	m[CustomPreMediatorKey] = "None"
 	m[CustomPostMediatorKey] = "None"
 	m[MemoryLoggerQoSKey] = defaultMemLogSize
+	m[LogSpoolKey] = "None"
+	m[LogSpoolLimitKey] = defaultMaxSpoolBytes
+	m[LogFlushIntervalKey] = time.Duration(0)
+	m[LogFlushBytesKey] = 0
+	m[RedactionKey] = "None"
+	m[AccessLogFormatKey] = DEFAULTLOG.String()
+	m[AccessLogExclusionsKey] = strings.Join(defaultAccessLogExclusions, ",")
+	m[TraceExporterKey] = "None"
+	m[ReadinessChecksKey] = "None"
+	m[LivenessChecksKey] = "None"
+	m[PreStopDelayKey] = time.Duration(0)
+	m[LifecycleHooksKey] = "None"
+	m[ShutdownSignalsKey] = signalNames(defaultShutdownSignals)
+	m[RouteGroupsKey] = "None"
+	m[PanicReporterKey] = "None"
+	m[TimeoutResponseKey] = defaultTimeoutStatus
+	m[ReadTimeoutKey] = defaultReadTimeout / time.Second
+	m[ReadHeaderTimeoutKey] = defaultReadHeaderTimeout / time.Second
+	m[WriteTimeoutKey] = defaultWriteTimeout / time.Second
+	m[IdleTimeoutKey] = defaultIdleTimeout / time.Second
+	m[MaxHeaderBytesKey] = http.DefaultMaxHeaderBytes
+	m[MaxBodyBytesKey] = int64(0)
+	m[KeepAlivesKey] = true
+	m[H2CKey] = false
+	m[TLSCertKey] = "None"
+	m[TLSKeyKey] = "None"
+	m[TLSMinVersionKey] = tlsVersionName(defaultTLSMinVersion)
+	m[TLSCipherSuitesKey] = "Default"
+	m[TLSClientCAKey] = "None"
+	m[TLSClientAuthKey] = "None"
+	m[BindAddressKey] = defaultBindAddress
+	m[UnixSocketKey] = "None"
+	m[SocketActivationKey] = false
+	m[UpgradeTimeoutKey] = time.Duration(0)
+	m[ConfigFileKey] = "None"
+	m[EnvPrefixKey] = "None"
+	m[ConfigSourcesKey] = "None"
 
 	return m
 }
 
-const (
-	customPostMediatorPos int = iota
-	suspendMediatorPos
-	memoryLoggerMediatorPos
-	tracingMediatorPos
-	authStrategyMediatorPos
-	customAuthorizerPos
-	timeoutHandlerPos
-	customPreMediatorPos
-)
-
-func initDefaultHandlerChain() {
-	handlerChain[customPostMediatorPos] = noopHandler /* custom post mediator */
-	handlerChain[suspendMediatorPos]= suspendMediator
-	handlerChain[memoryLoggerMediatorPos]= memoryPostLoggingMediator
-	handlerChain[tracingMediatorPos] = tracingMediator
-	handlerChain[authStrategyMediatorPos] = noAuthMediator
-	handlerChain[customAuthorizerPos] = noopHandler /* custom authorizer */
-//	handlerChain[timeoutHandlerPos] = timeoutMediator
-	handlerChain[timeoutHandlerPos] = noopHandler
-
-	handlerChain[customPreMediatorPos] = noopHandler /* custom pre mediator */
-}
-
 func initBuiltServer(svcName string, port uint32, b *NicoBuilder, s *http.Server) {
 	b.props[ListenPortKey] = port
 	b.server.server = s
@@ -393,10 +678,45 @@ func initBuiltServer(svcName string, port uint32, b *NicoBuilder, s *http.Server
 	//init built server
 	b.server.svcName = svcName
 	b.server.port = port
+	b.server.tracer.svcName = svcName
+	b.server.logDir = defaultLogFileDir
+	if b.flagset["logFileDir"] {
+		b.server.logDir = b.stringFlag("logFileDir")
+	}
 
-	b.server.handlerTimeout = (b.props[HandlerTimeoutKey]).(time.Duration)
-	b.server.shutdownWait = (b.props[ShutdownWaitKey]).(time.Duration)
+	if b.flagset["handlerTimeout"] {
+		b.setDuration(HandlerTimeoutKey, b.durationFlag("handlerTimeout"))
+	}
+	b.server.handlerTimeout = b.duration(HandlerTimeoutKey)
+	if b.flagset["shutdownTimeout"] {
+		b.setDuration(ShutdownWaitKey, b.durationFlag("shutdownTimeout"))
+	}
+	b.server.shutdownWait = b.duration(ShutdownWaitKey)
+	if b.flagset["preStopDelay"] {
+		b.setDuration(PreStopDelayKey, b.durationFlag("preStopDelay"))
+	}
+	b.server.preStopDelay = b.duration(PreStopDelayKey)
 
 	b.server.sink, _ = getLogSink((b.props[LogSinkKey]).(string))
 	b.server.logQoS = (b.props[MemoryLoggerQoSKey]).(int)
+	if lt, ok := (b.props[MemoryLoggerTypeKey]).(memoryLoggerType); ok && lt == MemoryBound {
+		b.server.logQoS = defaultMemLogSize
+	}
+	b.server.logBytesQoS = (b.props[LogFlushBytesKey]).(int)
+	if b.flagset["logFlushInterval"] {
+		b.setDuration(LogFlushIntervalKey, b.durationFlag("logFlushInterval"))
+	}
+	b.server.logFlushInterval = b.duration(LogFlushIntervalKey)
+	if b.flagset["accessLogFormat"] {
+		/* validated with the base flags */
+		b.server.accessLog.format, _ = getAccessLogFormat(b.stringFlag("accessLogFormat"))
+		b.props[AccessLogFormatKey] = b.server.accessLog.String()
+	}
+	if dir := (b.props[LogSpoolKey]).(string); dir != "None" && !b.disabledMemoryLogs {
+		if dir == "" {
+			dir = logFileDir(b.server)
+		}
+		b.server.spoolDir = dir
+		b.server.spoolMax = (b.props[LogSpoolLimitKey]).(int64)
+	}
 }
@@ -0,0 +1,404 @@
+package nicohttp
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultClientTimeout time.Duration = 30 * time.Second
+	defaultClientRetries int = 2
+	defaultBackoffBase time.Duration = 100 * time.Millisecond
+	defaultBackoffMax time.Duration = 5 * time.Second
+)
+
+type credentialsContextKey struct{}
+type userContextKey struct{}
+
+// CredentialSource - returns the Authorization header value for an outbound request
+type CredentialSource func(ctx context.Context) (string, error)
+
+// ClientOption - optional behaviour of the client returned by NicoServer.NewClient
+type ClientOption func(c *clientConfig)
+
+type clientConfig struct {
+	name string
+	timeout time.Duration
+	retries int
+	backoffBase time.Duration
+	backoffMax time.Duration
+	forwardAuth bool
+	credentials CredentialSource
+	breaker *CircuitBreaker
+	base http.RoundTripper
+}
+
+// nicoTransport - RoundTripper propagating request ID, trace context and credentials of the
+// incoming request found in the outbound request's context, with retries and logging
+type nicoTransport struct {
+	server *NicoServer
+	config clientConfig
+}
+
+
+// ClientName - name of the dependency, used in outbound log entries and spans
+func ClientName(name string) ClientOption {
+	return func(c *clientConfig) {
+		c.name = name
+	}
+}
+
+
+// ClientTimeout - overall timeout of a call, retries included. Default is 30s
+func ClientTimeout(d time.Duration) ClientOption {
+	return func(c *clientConfig) {
+		c.timeout = d
+	}
+}
+
+
+// ClientRetries - retry idempotent calls failing with a network error, 429, 502, 503 or 504 up
+// to n times, backing off exponentially from base to max with full jitter. Default is 2 retries
+func ClientRetries(n int, base, max time.Duration) ClientOption {
+	return func(c *clientConfig) {
+		c.retries = n
+		c.backoffBase = base
+		c.backoffMax = max
+	}
+}
+
+
+// ForwardAuthorization - forward the Authorization header of the incoming request
+func ForwardAuthorization() ClientOption {
+	return func(c *clientConfig) {
+		c.forwardAuth = true
+	}
+}
+
+
+// ServiceCredentials - authenticate outbound calls as the service, used when no incoming
+// credentials are forwarded
+func ServiceCredentials(src CredentialSource) ClientOption {
+	return func(c *clientConfig) {
+		c.credentials = src
+	}
+}
+
+
+// ClientTransport - the RoundTripper making the calls. Default is http.DefaultTransport
+func ClientTransport(rt http.RoundTripper) ClientOption {
+	return func(c *clientConfig) {
+		c.base = rt
+	}
+}
+
+
+// NewClient - returns an http.Client for calling other services. Requests created with the
+// incoming request's context (http.NewRequestWithContext(r.Context(), ...)) carry its request
+// ID, trace context and, if configured, its credentials. Calls are logged to the memory log
+func (h *NicoServer) NewClient(opts ...ClientOption) (*http.Client) {
+	c := clientConfig{
+		timeout: defaultClientTimeout,
+		retries: defaultClientRetries,
+		backoffBase: defaultBackoffBase,
+		backoffMax: defaultBackoffMax,
+		base: http.DefaultTransport,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if c.breaker != nil {
+		c.breaker.logTo(h)
+	}
+	return &http.Client{Timeout: c.timeout, Transport: &nicoTransport{server: h, config: c}}
+}
+
+
+/**************** Credential sources **********************/
+
+// BasicCredentials - HTTP Basic credentials, matching the BASIC auth strategy
+func BasicCredentials(user, password string) CredentialSource {
+	v := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	return func(ctx context.Context) (string, error) {
+		return v, nil
+	}
+}
+
+
+// BearerToken - a static bearer token
+func BearerToken(token string) CredentialSource {
+	return func(ctx context.Context) (string, error) {
+		return "Bearer " + token, nil
+	}
+}
+
+
+// HMACJWTCredentials - mints HS256 JWTs for subject, matching the JWTHMAC auth strategy
+func HMACJWTCredentials(issuer, subject string, secret []byte, ttl time.Duration) CredentialSource {
+	return func(ctx context.Context) (string, error) {
+		signingInput, err := jwtSigningInput("HS256", issuer, subject, ttl)
+		if err != nil {
+			return "", err
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signingInput))
+		return "Bearer " + signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+	}
+}
+
+
+// RSAJWTCredentials - mints RS256 JWTs for subject, matching the JWTRSA auth strategy
+func RSAJWTCredentials(issuer, subject string, key *rsa.PrivateKey, ttl time.Duration) CredentialSource {
+	return func(ctx context.Context) (string, error) {
+		signingInput, err := jwtSigningInput("RS256", issuer, subject, ttl)
+		if err != nil {
+			return "", err
+		}
+		digest := sha256.Sum256([]byte(signingInput))
+		sig, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+	}
+}
+
+
+func jwtSigningInput(alg, issuer, subject string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	hdr, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{"iss": issuer, "sub": subject, "iat": now.Unix(), "exp": now.Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(claims), nil
+}
+
+
+/**************** Incoming request context **********************/
+
+// AuthenticatedUser - the user authenticated by the auth mediator, "" outside of a request
+func AuthenticatedUser(ctx context.Context) string {
+	u, _ := ctx.Value(userContextKey{}).(string)
+	return u
+}
+
+
+// authenticated - records the authenticated user and the credentials it presented on the request,
+// replacing any X-AUTH-USER the client sent
+func authenticated(r *http.Request, user string) *http.Request {
+	r.Header.Set("X-AUTH-USER", user)
+	ctx := context.WithValue(r.Context(), userContextKey{}, user)
+	if hdr := r.Header.Get("Authorization"); hdr != "" {
+		ctx = context.WithValue(ctx, credentialsContextKey{}, hdr)
+	}
+	return r.WithContext(ctx)
+}
+
+
+/**************** Transport **********************/
+
+// RoundTrip - http.RoundTripper implementation
+func (t *nicoTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	out := req.Clone(ctx)
+	if id := RequestID(ctx); id != "" && out.Header.Get(requestIDHeader) == "" {
+		out.Header.Set(requestIDHeader, id)
+	}
+	if err := t.authorize(ctx, out); err != nil {
+		return nil, err
+	}
+
+	spanName := fmt.Sprintf("%s %s", req.Method, req.URL.Host)
+	if t.config.name != "" {
+		spanName = fmt.Sprintf("%s %s", req.Method, t.config.name)
+	}
+	_, span := StartSpan(ctx, spanName, SpanKindClient)
+	if span != nil {
+		out.Header.Set(traceparentHeader, span.Traceparent())
+		if span.TraceState != "" {
+			out.Header.Set(tracestateHeader, span.TraceState)
+		}
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.url", req.URL.String())
+	}
+
+	start := time.Now()
+	var resp *http.Response
+	attempts := 0
+	err := t.allow()
+	if err == nil {
+		resp, attempts, err = t.send(ctx, out)
+		t.record(resp, err)
+	}
+	t.logCall(ctx, out, resp, attempts, time.Since(start), err)
+	if span != nil {
+		if resp != nil {
+			span.SetAttribute("http.status_code", resp.StatusCode)
+			if resp.StatusCode >= http.StatusInternalServerError {
+				span.SetError(errors.New(http.StatusText(resp.StatusCode)))
+			}
+		}
+		span.SetAttribute("http.attempts", attempts)
+		span.SetError(err)
+		span.Finish()
+	}
+	return resp, err
+}
+
+
+func (t *nicoTransport) allow() error {
+	if t.config.breaker == nil {
+		return nil
+	}
+	if err := t.config.breaker.Allow(); err != nil {
+		return fmt.Errorf("%s: %w", t.config.breaker.Name(), err)
+	}
+	return nil
+}
+
+
+func (t *nicoTransport) record(resp *http.Response, err error) {
+	if t.config.breaker != nil {
+		t.config.breaker.Record(breakerOutcome(resp, err))
+	}
+}
+
+
+func (t *nicoTransport) authorize(ctx context.Context, out *http.Request) error {
+	if out.Header.Get("Authorization") != "" {
+		return nil
+	}
+	if t.config.forwardAuth {
+		if hdr, ok := ctx.Value(credentialsContextKey{}).(string); ok {
+			out.Header.Set("Authorization", hdr)
+			return nil
+		}
+	}
+	if t.config.credentials != nil {
+		v, err := t.config.credentials(ctx)
+		if err != nil {
+			return fmt.Errorf("service credentials: %w", err)
+		}
+		out.Header.Set("Authorization", v)
+	}
+	return nil
+}
+
+
+func (t *nicoTransport) send(ctx context.Context, req *http.Request) (*http.Response, int, error) {
+	retries := t.config.retries
+	if !retryable(req) {
+		retries = 0
+	}
+	attempt := 0
+	for {
+		attempt++
+		resp, err := t.config.base.RoundTrip(req)
+		if attempt > retries || !shouldRetry(ctx, resp, err) {
+			return resp, attempt, err
+		}
+		wait := backoff(attempt, t.config.backoffBase, t.config.backoffMax, resp)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if req.GetBody != nil && req.Body != nil && req.Body != http.NoBody {
+			body, berr := req.GetBody()
+			if berr != nil {
+				return nil, attempt, berr
+			}
+			req.Body = body
+		}
+		timer := time.NewTimer(wait)
+		select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, attempt, ctx.Err()
+		}
+	}
+}
+
+
+// retryable - idempotent methods, or any method carrying an Idempotency-Key, whose body can be replayed
+func retryable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+			return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+
+func shouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+	}
+	return false
+}
+
+
+// backoff - exponential backoff with full jitter, a Retry-After (seconds) header takes precedence
+func backoff(attempt int, base, max time.Duration, resp *http.Response) time.Duration {
+	if resp != nil {
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+			if d := time.Duration(s) * time.Second; d < max {
+				return d
+			}
+			return max
+		}
+	}
+	ceiling := base << uint(attempt-1)
+	if ceiling <= 0 || ceiling > max {
+		ceiling = max
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+
+func (t *nicoTransport) logCall(ctx context.Context, req *http.Request, resp *http.Response, attempts int, d time.Duration, err error) {
+	if t.server == nil {
+		return
+	}
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	name := t.config.name
+	if name == "" {
+		name = req.URL.Host
+	}
+	msg := fmt.Sprintf("Outbound: requestID=%s, dependency=%s, %s %s ; Response: status=%d, attempts=%d, duration=%s",
+		RequestID(ctx), name, req.Method, req.URL.String(), status, attempts, d)
+	if err != nil {
+		msg = fmt.Sprintf("%s, error=%s", msg, err)
+	}
+	emitLogEntry(t.server, msg)
+}
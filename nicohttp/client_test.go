@@ -0,0 +1,96 @@
+package nicohttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+
+func TestClientPropagation(t *testing.T) {
+	var calls int32
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		got = r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	b := GetBuilder().WithDefaults().WithTraceExporter(NewInMemoryExporter())
+	client := b.server.NewClient(ForwardAuthorization(), ClientRetries(3, time.Millisecond, 5*time.Millisecond))
+
+	/* simulate the context of an incoming, authenticated and traced request */
+	incoming := httptest.NewRequest(http.MethodGet, "/regions", nil)
+	incoming.Header.Set("Authorization", "Bearer incoming-token")
+	incoming = authenticated(incoming, "bob")
+	span := b.server.tracer.newSpan("GET /regions", SpanKindServer, "", "", 0, "")
+	ctx := ContextWithSpan(ContextWithRequestID(incoming.Context(), "rid-1"), span)
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, upstream.URL+"/zones", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("%s: status = %d after %d calls", t.Name(), resp.StatusCode, calls)
+	}
+	if got.Get(requestIDHeader) != "rid-1" || got.Get("Authorization") != "Bearer incoming-token" {
+		t.Fatalf("%s: request ID or credentials not propagated: %v", t.Name(), got)
+	}
+	if traceID, parentID, _, ok := parseTraceparent(got.Get(traceparentHeader)); !ok || traceID != span.TraceID || parentID == span.SpanID {
+		t.Fatalf("%s: traceparent not propagated from a client span: %s", t.Name(), got.Get(traceparentHeader))
+	}
+}
+
+
+func TestClientNoRetryForPost(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	client := GetBuilder().server.NewClient(ClientRetries(3, time.Millisecond, time.Millisecond),
+		ServiceCredentials(BasicCredentials("svc", "secret")))
+	resp, err := client.Post(upstream.URL, "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	resp.Body.Close()
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("%s: POST without Idempotency-Key retried, calls = %d", t.Name(), calls)
+	}
+}
+
+
+func TestHMACJWTCredentials(t *testing.T) {
+	v, err := HMACJWTCredentials("regions", "regions-service", []byte("secret"), time.Minute)(context.Background())
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if !strings.HasPrefix(v, "Bearer ") || strings.Count(v, ".") != 2 {
+		t.Fatalf("%s: not a bearer JWT: %s", t.Name(), v)
+	}
+}
+
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt < 10; attempt++ {
+		if d := backoff(attempt, 10*time.Millisecond, 50*time.Millisecond, nil); d < 0 || d > 50*time.Millisecond {
+			t.Fatalf("%s: attempt %d backoff %s out of range", t.Name(), attempt, d)
+		}
+	}
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"1"}}}
+	if d := backoff(1, time.Millisecond, 5*time.Second, resp); d != time.Second {
+		t.Fatalf("%s: Retry-After not honoured, backoff = %s", t.Name(), d)
+	}
+}
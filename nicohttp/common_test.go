@@ -16,6 +16,7 @@ const (
 	uriSuspend string = "/suspend"
 	uriRestart string = "/restart"
 	uriBuilder string = "/builder"
+	uriDumpLog string = "/dumplog"
 	
 	applicationJSON = "application/json"
 )
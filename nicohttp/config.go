@@ -0,0 +1,235 @@
+package nicohttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	configFlag string = "config"
+	masked string = "*****"
+)
+
+/* flags whose values /builder masks */
+var secretFlagWords = []string{"password", "secret", "token", "apikey", "credential"}
+
+// configSetting - the effective value of a flag and where it came from: flag, env:<variable>,
+// file:<path> or default
+type configSetting struct {
+	Value string `json:"value"`
+	Source string `json:"source"`
+}
+
+
+// WithConfigFile - read flag values from the JSON, YAML or TOML file at path, keyed by flag name.
+// Values from the environment and the command line take precedence, -config overrides the path
+func (b *NicoBuilder) WithConfigFile(path string) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	initConfigFlag(b.flags)
+	b.props[ConfigFileKey] = path
+	return b
+}
+
+
+// WithEnvPrefix - prefix of the environment variables setting flags, e.g. BILLING for
+// BILLING_LISTEN_PORT. Default is the service name, upper cased with _ for separators
+func (b *NicoBuilder) WithEnvPrefix(prefix string) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.props[EnvPrefixKey] = prefix
+	return b
+}
+
+
+// initConfigFlag - defines -config on fs, unless another builder sharing fs already did. Defined
+// along with the options using it, so that it exists when the application parses fs before Create
+func initConfigFlag(fs *flag.FlagSet) {
+	if fs.Lookup(configFlag) != nil {
+		return
+	}
+	fs.String(configFlag, "", "[OPTIONAL] JSON, YAML or TOML file of flag values, overridden by environment variables and flags")
+}
+
+
+// applyConfig - sets the flags not given on the command line from the environment, then from the
+// config file, and records the source of every flag in the builder props
+func applyConfig(b *NicoBuilder, svcName string) error {
+	sources := make(map[string]string)
+	for name := range b.flagset {
+		sources[name] = "flag"
+	}
+
+	prefix := (b.props[EnvPrefixKey]).(string)
+	if prefix == "None" {
+		prefix = envPrefix(svcName)
+		b.props[EnvPrefixKey] = prefix
+	}
+	var err error
+	b.flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || b.flagset[f.Name] || f.Name == configFlag {
+			return
+		}
+		env := envName(prefix, f.Name)
+		if v, ok := os.LookupEnv(env); ok {
+			if serr := f.Value.Set(v); serr != nil {
+				err = fmt.Errorf("config: %s: %w", env, serr)
+				return
+			}
+			b.flagset[f.Name] = true
+			sources[f.Name] = "env:" + env
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	path := (b.props[ConfigFileKey]).(string)
+	if b.flagset[configFlag] {
+		path = b.stringFlag(configFlag)
+		b.props[ConfigFileKey] = path
+	}
+	if path != "None" && path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+		for name, v := range values {
+			f := b.flags.Lookup(name)
+			if f == nil || name == configFlag {
+				return fmt.Errorf("config: %s: unknown flag %s", path, name)
+			}
+			if b.flagset[name] {
+				continue
+			}
+			if err := f.Value.Set(v); err != nil {
+				return fmt.Errorf("config: %s: %s: %w", path, name, err)
+			}
+			b.flagset[name] = true
+			sources[name] = "file:" + path
+		}
+	}
+
+	settings := make(map[string]configSetting)
+	b.flags.VisitAll(func(f *flag.Flag) {
+		source, ok := sources[f.Name]
+		if !ok {
+			source = "default"
+		}
+		value := f.Value.String()
+		if value != "" && secretFlag(f.Name) {
+			value = masked
+		}
+		settings[f.Name] = configSetting{Value: value, Source: source}
+	})
+	b.props[ConfigSourcesKey] = settings
+	return nil
+}
+
+
+// checkConfigWithoutFlags - WithConfigFile and WithEnvPrefix only set flags, a builder without base
+// or added flags would ignore them
+func checkConfigWithoutFlags(b *NicoBuilder) error {
+	if (b.props[ConfigFileKey]).(string) != "None" || (b.props[EnvPrefixKey]).(string) != "None" {
+		return errors.New("config: WithConfigFile and WithEnvPrefix set flags, use WithBaseFlags or add flags")
+	}
+	return nil
+}
+
+
+// envPrefix - the service name upper cased, with _ for anything but letters and digits
+func envPrefix(svcName string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, svcName)
+}
+
+
+// envName - the environment variable of a flag, e.g. BILLING_TLS_CLIENT_CA for tlsClientCA
+func envName(prefix, flagName string) string {
+	var sb strings.Builder
+	if prefix != "" {
+		sb.WriteString(prefix)
+		sb.WriteByte('_')
+	}
+	runes := []rune(flagName)
+	for i, r := range runes {
+		switch {
+			case unicode.IsUpper(r) && i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])):
+				sb.WriteByte('_')
+			case unicode.IsUpper(r) && i > 0 && i + 1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]):
+				sb.WriteByte('_')
+			case r == '-' || r == '.':
+				sb.WriteByte('_')
+				continue
+		}
+		sb.WriteRune(unicode.ToUpper(r))
+	}
+	return sb.String()
+}
+
+
+func secretFlag(name string) bool {
+	lower := strings.ToLower(name)
+	for _, w := range secretFlagWords {
+		if strings.Contains(lower, w) {
+			return true
+		}
+	}
+	return false
+}
+
+
+// readConfigFile - the flag values of a config file, top level keys named after the flags, decoded
+// by its extension: .json, .yaml, .yml or .toml
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+		case ".json":
+			dec := json.NewDecoder(bytes.NewReader(data))
+			dec.UseNumber()
+			err = dec.Decode(&m)
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(data, &m)
+		case ".toml":
+			err = toml.Unmarshal(data, &m)
+		default:
+			return nil, fmt.Errorf("%s: unsupported config format, use .json, .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	values := make(map[string]string)
+	for k, v := range m {
+		switch v := v.(type) {
+			case string:
+				values[k] = v
+			case float64:
+				values[k] = strconv.FormatFloat(v, 'f', -1, 64)
+			case json.Number, bool, int, int64:
+				values[k] = fmt.Sprint(v)
+			default:
+				/* lists, tables, nulls and dates do not map to a flag */
+				return nil, fmt.Errorf("%s: %s is not a flag value", path, k)
+		}
+	}
+	return values, nil
+}
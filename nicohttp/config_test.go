@@ -0,0 +1,183 @@
+package nicohttp
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	return path
+}
+
+
+func TestConfigPrecedence(t *testing.T) {
+	for name, content := range map[string]string{
+		"svc.json": `{"region": "file-region", "workers": 4, "zone": "file-zone"}`,
+		"svc.yaml": "# billing\nregion: file-region\nworkers: 4\nzone: \"file-zone\"\n",
+		"svc.toml": "# billing\nregion = \"file-region\"\nworkers = 4\nzone = 'file-zone'\n",
+	} {
+		path := writeConfig(t, name, content)
+		t.Setenv("NICO_TEST_WORKERS", "8")
+		t.Setenv("NICO_TEST_ZONE_ID", "ignored, not a flag")
+		t.Setenv("NICO_TEST_API_TOKEN", "s3cret")
+
+		fs := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+		b, region := GetBuilder().WithDefaults().WithNoMemoryLogger().WithoutStdLog().WithFlagSet(fs).
+			WithEnvPrefix("NICO_TEST").WithStringFlag("region", "default-region", "region served", false)
+		b, workers := b.WithIntFlag("workers", 1, "workers", false)
+		b, zone := b.WithStringFlag("zone", "default-zone", "zone served", false)
+		b, apiToken := b.WithStringFlag("apiToken", "", "token of the upstream API", false)
+		b, cell := b.WithStringFlag("cell", "default-cell", "cell served", false)
+		/* -config is defined by WithConfigFile or WithBaseFlags, or else by Create */
+		initConfigFlag(fs)
+		fs.Parse([]string{"-config", path, "-region", "flag-region"})
+		if _, err := b.Create(t.Name(), getLoggerPort()); err != nil {
+			t.Fatalf("%s: %s: %s", t.Name(), name, err)
+		}
+
+		if *region != "flag-region" || *workers != 8 || *zone != "file-zone" || *cell != "default-cell" || *apiToken != "s3cret" {
+			t.Fatalf("%s: %s: region %s, workers %d, zone %s, cell %s", t.Name(), name, *region, *workers, *zone, *cell)
+		}
+		settings := b.Props()[ConfigSourcesKey].(map[string]configSetting)
+		expected := map[string]configSetting{
+			"region": {Value: "flag-region", Source: "flag"},
+			"workers": {Value: "8", Source: "env:NICO_TEST_WORKERS"},
+			"zone": {Value: "file-zone", Source: "file:" + path},
+			"cell": {Value: "default-cell", Source: "default"},
+			"apiToken": {Value: masked, Source: "env:NICO_TEST_API_TOKEN"},
+		}
+		for flagName, want := range expected {
+			if settings[flagName] != want {
+				t.Fatalf("%s: %s: %s is %+v, expected %+v", t.Name(), name, flagName, settings[flagName], want)
+			}
+		}
+	}
+}
+
+
+func TestConfigFile(t *testing.T) {
+	fs := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	path := writeConfig(t, "svc.json", `{"region": "eu-west", "workers": 3}`)
+	b, region := GetBuilder().WithDefaults().WithNoMemoryLogger().WithoutStdLog().WithFlagSet(fs).
+		WithConfigFile(path).WithStringFlag("region", "", "region served", true)
+	b, workers := b.WithIntFlag("workers", 1, "workers", false)
+	fs.Parse([]string{})
+	/* the required flag comes from the file */
+	if _, err := b.Create(t.Name(), getLoggerPort()); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if *region != "eu-west" || *workers != 3 {
+		t.Fatalf("%s: region %s, workers %d", t.Name(), *region, *workers)
+	}
+	if b.Props()[EnvPrefixKey] != envPrefix(t.Name()) {
+		t.Fatalf("%s: env prefix %s", t.Name(), b.Props()[EnvPrefixKey])
+	}
+}
+
+
+func TestConfigValues(t *testing.T) {
+	expected := map[string]string{"region": "us-east", "workers": "4", "h2c": "true", "handlerTimeout": "30s",
+		"motd": "it's #1\nwelcome", "ratio": "0.5"}
+	for name, content := range map[string]string{
+		"svc.json": `{"region": "us-east", "workers": 4, "h2c": true, "handlerTimeout": "30s",
+			"motd": "it's #1\nwelcome", "ratio": 0.5}`,
+		"svc.yaml": "---\nbase: &region us-east\nregion: *region # primary\nworkers: 4\nh2c: true\n" +
+			"handlerTimeout: '30s'\nmotd: |-\n  it's #1\n  welcome\nratio: 0.5\n",
+		"svc.yml": "region: \"us-east\"\nworkers: 4\nh2c: true\nhandlerTimeout: 30s\nmotd: \"it's #1\\nwelcome\"\nratio: .5\n",
+		"svc.toml": "# service\nregion = \"us-east\"\nworkers = 4 # per core\nh2c = true\nhandlerTimeout = \"30s\"\n" +
+			"motd = \"\"\"\nit's #1\nwelcome\"\"\"\nratio = 0.5\n",
+	} {
+		values, err := readConfigFile(writeConfig(t, name, content))
+		if err != nil {
+			t.Fatalf("%s: %s: %s", t.Name(), name, err)
+		}
+		/* the YAML anchor itself is a key of the file */
+		delete(values, "base")
+		if !reflect.DeepEqual(values, expected) {
+			t.Fatalf("%s: %s read as %v", t.Name(), name, values)
+		}
+	}
+}
+
+
+func TestConfigErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown.json": `{"regoin": "us-east"}`,
+		"value.json": `{"workers": "many"}`,
+		"object.json": `{"region": {"name": "us-east"}}`,
+		"unknown.yaml": "regoin: us-east\n",
+		"list.yaml": "region:\n  - us-east\n  - eu-west\n",
+		"nested.yaml": "server:\n  region: us-east\n",
+		"syntax.yaml": "region: [us-east\n",
+		"value.toml": "workers = many\n",
+		"table.toml": "[server]\nregion = \"us-east\"\n",
+		"list.toml": "region = [\"us-east\", \"eu-west\"]\n",
+		"svc.ini": "region=us-east\n",
+	} {
+		fs := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+		b, _ := GetBuilder().WithDefaults().WithNoMemoryLogger().WithoutStdLog().WithFlagSet(fs).
+			WithConfigFile(writeConfig(t, name, content)).WithStringFlag("region", "", "region served", false)
+		b, _ = b.WithIntFlag("workers", 1, "workers", false)
+		fs.Parse([]string{})
+		_, err := b.Create(t.Name(), getLoggerPort())
+		if err == nil || !strings.HasPrefix(err.Error(), "config: ") {
+			t.Fatalf("%s: %s: expected a config error, got %v", t.Name(), name, err)
+		}
+	}
+}
+
+
+func TestConfigFlagParsedBeforeCreate(t *testing.T) {
+	path := writeConfig(t, "svc.json", `{"region": "eu-west"}`)
+	fs := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	b, region := GetBuilder().WithDefaults().WithNoMemoryLogger().WithoutStdLog().WithFlagSet(fs).
+		WithConfigFile("").WithStringFlag("region", "", "region served", false)
+	/* the application parses its flags, -config included, before creating the server */
+	if err := fs.Parse([]string{"-config", path}); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if _, err := b.Create(t.Name(), getLoggerPort()); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if *region != "eu-west" {
+		t.Fatalf("%s: region %s", t.Name(), *region)
+	}
+}
+
+
+func TestConfigWithoutFlags(t *testing.T) {
+	for name, b := range map[string]*NicoBuilder{
+		"file": GetBuilder().WithDefaults().WithNoMemoryLogger().WithoutStdLog().
+			WithFlagSet(flag.NewFlagSet(t.Name(), flag.ContinueOnError)).WithConfigFile(writeConfig(t, "svc.json", `{}`)),
+		"env": GetBuilder().WithDefaults().WithNoMemoryLogger().WithoutStdLog().
+			WithFlagSet(flag.NewFlagSet(t.Name(), flag.ContinueOnError)).WithEnvPrefix("NICO_TEST"),
+	} {
+		if _, err := b.Create(t.Name(), getLoggerPort()); err == nil || !strings.HasPrefix(err.Error(), "config: ") {
+			t.Fatalf("%s: %s: expected a config error, got %v", t.Name(), name, err)
+		}
+	}
+}
+
+
+func TestEnvName(t *testing.T) {
+	for flagName, want := range map[string]string{
+		"listenPort": "BILLING_API_LISTEN_PORT",
+		"tlsClientCA": "BILLING_API_TLS_CLIENT_CA",
+		"h2c": "BILLING_API_H2C",
+		"HTTPPort": "BILLING_API_HTTP_PORT",
+		"log-dir": "BILLING_API_LOG_DIR",
+	} {
+		if got := envName(envPrefix("billing-api"), flagName); got != want {
+			t.Fatalf("%s: %s maps to %s, expected %s", t.Name(), flagName, got, want)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package nicohttp
+
+import (
+	"errors"
+	"runtime"
+)
+
+
+func diskFreeBytes(dir string) (uint64, error) {
+	return 0, errors.New("disk space check not supported on " + runtime.GOOS)
+}
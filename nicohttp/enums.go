@@ -6,12 +6,12 @@ import (
 
 
 func (auth authNStrategy) String() string {
-	return [...]string{"JWTRSA", "BASIC", "JWTHMAC", "LDAP", "NOAUTH"}[auth]
+	return [...]string{"JWTRSA", "BASIC", "JWTHMAC", "LDAP", "NOAUTH", "MTLS"}[auth]
 }
 
 
 func getAuthStrategy(auth string) (authNStrategy, error) {
-	s := map[string]int {"JWTRSA":0, "BASIC":1, "JWTHMAC":2, "LDAP":3, "NOAUTH":4}
+	s := map[string]int {"JWTRSA":0, "BASIC":1, "JWTHMAC":2, "LDAP":3, "NOAUTH":4, "MTLS":5}
 	if val, ok := s[auth]; ok {
 		return authNStrategy(val), nil
 	}
@@ -44,3 +44,27 @@ func getLoggerType(l string) (memoryLoggerType, error) {
 	}
 	return -1, errors.New("invalid argument")
 }
+
+
+func (format accessLogFormat) String() string {
+	return [...]string{"DEFAULTLOG", "COMBINED", "JSONLOG", "CUSTOM"}[format]
+}
+
+
+func getAccessLogFormat(format string) (accessLogFormat, error) {
+	f := map[string]int {"DEFAULTLOG":0, "COMBINED":1, "JSONLOG":2, "CUSTOM":3}
+	if val, ok := f[format]; ok {
+		return accessLogFormat(val), nil
+	}
+	return -1, errors.New("invalid argument")
+}
+
+
+func (state breakerState) String() string {
+	return [...]string{"closed", "open", "half-open"}[state]
+}
+
+
+func (phase hookPhase) String() string {
+	return [...]string{"OnStart", "OnReady", "OnSuspend", "OnRestart", "OnShutdown"}[phase]
+}
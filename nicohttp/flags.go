@@ -2,77 +2,138 @@ package nicohttp
 
 import (
 	"flag"
+	"net/http"
 	"time"
 	"os"
 	"fmt"
 	"strings"
 )
 
-// Required Base args
-var (
-	requiredBaseArgs int
-	argSvcName      *string
-)
 
-// Optional Base args
-var (
-	argListenPort     *int
-	argHandlerTimeout time.Duration
-	argRateLimit      *int
-	argShutdownWait   time.Duration
-	argLogFileDir   *string
-	argAuthStrategy   *string
-	argLogSink		*string
-	argMemoryLogsEnabled *bool
-	argMemoryLogType *string
-)
+// initBaseFlags - defines the base flags on fs, unless another builder sharing fs already did
+func initBaseFlags(fs *flag.FlagSet) {
+	if fs.Lookup("serviceName") != nil {
+		return
+	}
+	fs.String("serviceName", "", "[REQUIRED] name of the micro service")
+	fs.Int("listenPort", 8080, "[OPTIONAL] HTTP Server listen port")
+	fs.Duration("handlerTimeout", defaultHandlerTimeout, "[OPTIONAL] time handlers have to respond, e.g. 30s. Default is 300s")
+	fs.Int("rateLimit", 60 , "[OPTIONAL] rate limit - requests per minute")
+	fs.Duration("shutdownTimeout", 60*time.Second, "[OPTIONAL] graceful shutdown timeout in seconds")
+	fs.Duration("preStopDelay", 0, "[OPTIONAL] time to keep serving after readiness fails on shutdown, e.g. 5s. Default is 0")
+	fs.String("authStrategy", "NONE", "[OPTIONAL] JWT for JWT verification, NONE for no authentication")
+	fs.String("logFileDir", ".", "[OPTIONAL] Directory where log file will be written. Log file is <service-name>.log")
+	fs.String("logSink", ".", "[OPTIONAL] Log Sink can be File or Stdout. Default is File")
+	fs.Bool("memoryLogEnabled", true, "[OPTIONAL] Enable memory logs. Default is true")
+	fs.String("memoryLogType", ".", "[OPTIONAL] Either EntryBound or MemoryBound. Default is EntryBound")
+	fs.String("accessLogFormat", DEFAULTLOG.String(), "[OPTIONAL] DEFAULTLOG, COMBINED, JSONLOG or CUSTOM access log entries. Default is DEFAULTLOG")
+	fs.Duration("logFlushInterval", 0, "[OPTIONAL] Persist memory logs at least this often, e.g. 30s. Default is 0 (no periodic flush)")
+	fs.Duration("readTimeout", defaultReadTimeout, "[OPTIONAL] time to read a whole request, 0 for no limit. Default is 60s")
+	fs.Duration("readHeaderTimeout", defaultReadHeaderTimeout, "[OPTIONAL] time to read the request headers. Default is 10s")
+	fs.Duration("writeTimeout", defaultWriteTimeout, "[OPTIONAL] time to write the response, 0 for no limit. Default is 60s")
+	fs.Duration("idleTimeout", defaultIdleTimeout, "[OPTIONAL] time a keep-alive connection waits for the next request. Default is 60s")
+	fs.Int("maxHeaderBytes", http.DefaultMaxHeaderBytes, "[OPTIONAL] maximum size of the request headers. Default is 1MB")
+	fs.Int64("maxBodyBytes", 0, "[OPTIONAL] maximum size of request bodies, larger ones get a 413. Default is 0 (no limit)")
+	fs.Bool("keepAlives", true, "[OPTIONAL] enable HTTP keep-alives. Default is true")
+	fs.Bool("h2c", false, "[OPTIONAL] serve HTTP/2 without TLS. Default is false")
+	fs.String("tlsCert", "", "[OPTIONAL] PEM certificate file, serves HTTPS with -tlsKey")
+	fs.String("tlsKey", "", "[OPTIONAL] PEM private key file of -tlsCert")
+	fs.String("tlsMinVersion", "1.2", "[OPTIONAL] minimum TLS version, 1.2 or 1.3. Default is 1.2")
+	fs.String("tlsCipherSuites", "", "[OPTIONAL] comma separated TLS 1.2 cipher suites. Default is the Go default policy")
+	fs.String("tlsClientCA", "", "[OPTIONAL] PEM CA bundle verifying client certificates (mutual TLS)")
+	fs.String("tlsClientAuth", "require", "[OPTIONAL] require or optional client certificates with -tlsClientCA. Default is require")
+	fs.String("bindAddress", defaultBindAddress, "[OPTIONAL] interface to listen on, e.g. 127.0.0.1, ::1 or ::. Default is 0.0.0.0")
+	fs.String("unixSocket", "", "[OPTIONAL] unix domain socket path to listen on instead of -listenPort")
+	fs.Bool("socketActivation", false, "[OPTIONAL] serve on the socket passed by systemd (LISTEN_FDS). Default is false")
+	fs.Duration("upgradeTimeout", 0, "[OPTIONAL] time an upgraded process has to report ready, enables SIGHUP and /upgrade. Default is 0 (disabled)")
+}
+
+
+func (b *NicoBuilder) flagValue(name string) interface{} {
+	f := b.flags.Lookup(name)
+	if f == nil {
+		return nil
+	}
+	if g, ok := f.Value.(flag.Getter); ok {
+		return g.Get()
+	}
+	return f.Value.String()
+}
+
+
+func (b *NicoBuilder) stringFlag(name string) string {
+	v, _ := b.flagValue(name).(string)
+	return v
+}
 
-var (
-	flagset    = make(map[string]bool)
-)
+
+func (b *NicoBuilder) durationFlag(name string) time.Duration {
+	v, _ := b.flagValue(name).(time.Duration)
+	return v
+}
 
 
-func initBaseFlags() {
-	argSvcName = flag.String("serviceName", "", "[REQUIRED] name of the micro service")
-	argListenPort = flag.Int("listenPort", 8080, "[OPTIONAL] HTTP Server listen port")
-	flag.DurationVar(&argHandlerTimeout, "handlerTimeout",60*time.Second, "[OPTIONAL] handlerTimeout in seconds")
-	argRateLimit = flag.Int("rateLimit", 60 , "[OPTIONAL] rate limit - requests per minute")
-	flag.DurationVar(&argShutdownWait, "shutdownTimeout", 60*time.Second, "[OPTIONAL] graceful shutdown timeout in seconds")
-	argAuthStrategy = flag.String("authStrategy", "NONE", "[OPTIONAL] JWT for JWT verification, NONE for no authentication")
-	argLogFileDir = flag.String("logFileDir", ".", "[OPTIONAL] Directory where log file will be written. Log file is <service-name>.log")
-	argLogSink = flag.String("logSink", ".", "[OPTIONAL] Log Sink can be File or Stdout. Default is File")
-	argMemoryLogsEnabled = flag.Bool("memoryLogEnabled", true, "[OPTIONAL] Enable memory logs. Default is true")
-	argMemoryLogType = flag.String("memoryLogType", ".", "[OPTIONAL] Either EntryBound or MemoryBound. Default is EntryBound")
+func (b *NicoBuilder) intFlag(name string) int {
+	v, _ := b.flagValue(name).(int)
+	return v
 }
 
-func validateRequiredArgs() {
-	if flag.NFlag() < (builder.extendedRequiredFlags + requiredBaseArgs) {
-		fmt.Printf("Required args = %d, provided args = %d\n\n", (builder.extendedRequiredFlags + requiredBaseArgs), flag.NFlag())
-		flag.Usage()
+
+func (b *NicoBuilder) int64Flag(name string) int64 {
+	v, _ := b.flagValue(name).(int64)
+	return v
+}
+
+
+func (b *NicoBuilder) boolFlag(name string) bool {
+	v, _ := b.flagValue(name).(bool)
+	return v
+}
+
+
+// validateRequiredArgs - exits unless enough flags were given, on the command line, through the
+// environment or in the config file
+func validateRequiredArgs(b *NicoBuilder) {
+	provided := len(b.flagset)
+	if b.flagset[configFlag] {
+		provided--
+	}
+	if provided < (b.extendedRequiredFlags + b.requiredBaseArgs) {
+		fmt.Printf("Required args = %d, provided args = %d\n\n", (b.extendedRequiredFlags + b.requiredBaseArgs), provided)
+		b.flags.Usage()
 		os.Exit(1)
 	}
 
-	if *argSvcName == "" {
+	if b.baseFlags && b.stringFlag("serviceName") == "" {
 		fmt.Printf("Service name is required\n\n")
-		flag.Usage()
+		b.flags.Usage()
 		os.Exit(1)
 	}
 }
 
-func validateBaseArgs() {
-	if flagset["logFileDir"] {
-		if strings.HasSuffix(*argLogFileDir, "/") {
-			panic(fmt.Sprintf("logFileDir %s cannot end with a trailing /", *argLogFileDir))
+func validateBaseArgs(b *NicoBuilder) {
+	if !b.baseFlags {
+		return
+	}
+	logFileDir := b.stringFlag("logFileDir")
+	if b.flagset["logFileDir"] {
+		if strings.HasSuffix(logFileDir, "/") {
+			panic(fmt.Sprintf("logFileDir %s cannot end with a trailing /", logFileDir))
 		}
 	}
-	if _, err := os.Stat(*argLogFileDir); err != nil {
+	if _, err := os.Stat(logFileDir); err != nil {
 		if os.IsNotExist(err) {
-			panic(fmt.Sprintf("Log Directory %s does not exist", *argLogFileDir))
+			panic(fmt.Sprintf("Log Directory %s does not exist", logFileDir))
+		}
+	}
+	if b.flagset["logSink"] {
+		if _, err := getLogSink(b.stringFlag("logSink")); err != nil {
+			panic(fmt.Sprintf("Invalid log sink: %s", b.stringFlag("logSink")))
 		}
 	}
-	if flagset["logSink"] {
-		if _, err := getLogSink(*argLogSink); err != nil {
-			panic(fmt.Sprintf("Invalid log sink: %s", *argLogSink))
+	if b.flagset["accessLogFormat"] {
+		if _, err := getAccessLogFormat(b.stringFlag("accessLogFormat")); err != nil {
+			panic(fmt.Sprintf("Invalid access log format: %s", b.stringFlag("accessLogFormat")))
 		}
 	}
 }
@@ -9,7 +9,7 @@ import (
 )
 
 func isBase(path string) bool {
-	startsWith := []string{"/api", "/logs", "/dumplog", "/uptime", "/healthz", "/suspend", "/restart", "/shutdown", "/builder"}
+	startsWith := []string{"/api", "/logs", "/dumplog", "/uptime", "/healthz", "/livez", "/readyz", "/suspend", "/restart", "/shutdown", "/upgrade", "/builder", "/metrics", "/breakers"}
 	for _, v := range startsWith {
 		if b := strings.HasPrefix(path, v); b {
 			return true
@@ -20,10 +20,18 @@ func isBase(path string) bool {
 }
 
 
-func generateAPI(httpRouter *mux.Router) ([]string, []string, error) {
+// generateAPI - the inherited and service routes, and the routes of each route group by prefix
+func generateAPI(h *NicoServer) ([]string, []string, map[string][]string, error) {
 	inherited := make([]string, 0)
 	service := make([]string, 0)
-	err := httpRouter.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+	groups := make(map[string][]string)
+	err := h.httpRouter.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if g := h.groupByRoute(route); g != nil {
+			if groups[g.prefix] == nil {
+				groups[g.prefix] = make([]string, 0)
+			}
+			return nil
+		}
 		pathTemplate, err1 := route.GetPathTemplate()
 		methods, err2 := route.GetMethods()
 		queriesTemplate, _ := route.GetQueriesTemplates() // bug in mux
@@ -41,6 +49,8 @@ func generateAPI(httpRouter *mux.Router) ([]string, []string, error) {
 			}
 			if (isBase(pathTemplate)) {
 				inherited = append(inherited, s)
+			} else if g := h.groupOfRoute(ancestors); g != nil {
+				groups[g.prefix] = append(groups[g.prefix], s)
 			} else {
 				service = append(service, s)
 			}
@@ -49,7 +59,7 @@ func generateAPI(httpRouter *mux.Router) ([]string, []string, error) {
 		return fmt.Errorf("PathTemplateError: %s, MethodsError: %s", err1, err2)
 	})
 	if (err == nil) {
-		return inherited, service, nil
+		return inherited, service, groups, nil
 	}
-	return nil, nil, err
+	return nil, nil, nil, err
 }
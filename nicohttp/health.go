@@ -0,0 +1,288 @@
+package nicohttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultCheckTimeout time.Duration = 5 * time.Second
+	checkStatusOK string = "ok"
+	checkStatusFailed string = "failed"
+)
+
+// HealthCheck - a named readiness or liveness check, nil if healthy. Checks are expected to
+// honour the context deadline, and are reported failed when they do not return in time
+type HealthCheck func(ctx context.Context) error
+
+// CheckOption - optional behaviour of a registered check
+type CheckOption func(c *healthCheck)
+
+// Pinger - dependency that can be pinged, e.g. *sql.DB
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+type healthCheck struct {
+	name string
+	check HealthCheck
+	timeout time.Duration
+	cacheTTL time.Duration
+
+	mu sync.Mutex
+	last checkResult
+	lastRun time.Time
+	/* closed when the check in progress returns, nil if none is */
+	running chan struct{}
+}
+
+type checkResult struct {
+	Status string `json:"status"`
+	Error string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+	Cached bool `json:"cached,omitempty"`
+}
+
+type healthReport struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+
+// CheckTimeout - the check fails if it has not returned within d. Default is 5s
+func CheckTimeout(d time.Duration) CheckOption {
+	return func(c *healthCheck) {
+		c.timeout = d
+	}
+}
+
+
+// CheckCacheTTL - reuse the outcome of the check for d instead of running it on every probe.
+// Default is 0 (no caching)
+func CheckCacheTTL(d time.Duration) CheckOption {
+	return func(c *healthCheck) {
+		c.cacheTTL = d
+	}
+}
+
+
+// WithReadinessCheck - /readyz fails while the check fails
+func (b *NicoBuilder) WithReadinessCheck(name string, check HealthCheck, opts ...CheckOption) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.server.readinessChecks = append(b.server.readinessChecks, newHealthCheck(name, check, opts))
+	b.props[ReadinessChecksKey] = checkNames(b.server.readinessChecks)
+	return b
+}
+
+
+// WithLivenessCheck - /livez fails while the check fails. Only checks whose failure warrants a
+// restart of the service belong here
+func (b *NicoBuilder) WithLivenessCheck(name string, check HealthCheck, opts ...CheckOption) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.server.livenessChecks = append(b.server.livenessChecks, newHealthCheck(name, check, opts))
+	b.props[LivenessChecksKey] = checkNames(b.server.livenessChecks)
+	return b
+}
+
+
+func newHealthCheck(name string, check HealthCheck, opts []CheckOption) *healthCheck {
+	c := &healthCheck{name: name, check: check, timeout: defaultCheckTimeout}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+
+func checkNames(checks []*healthCheck) string {
+	names := make([]string, 0, len(checks))
+	for _, c := range checks {
+		names = append(names, c.name)
+	}
+	return strings.Join(names, ",")
+}
+
+
+/**************** Built in checks **********************/
+
+// PingCheck - pings a dependency such as a database
+func PingCheck(p Pinger) HealthCheck {
+	return func(ctx context.Context) error {
+		return p.PingContext(ctx)
+	}
+}
+
+
+// HTTPCheck - GET url must return a status below 400
+func HTTPCheck(url string) HealthCheck {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+
+// DiskSpaceCheck - the file system holding dir must have at least minFreeBytes available
+func DiskSpaceCheck(dir string, minFreeBytes uint64) HealthCheck {
+	return func(ctx context.Context) error {
+		free, err := diskFreeBytes(dir)
+		if err != nil {
+			return err
+		}
+		if free < minFreeBytes {
+			return fmt.Errorf("%s has %d bytes free, %d required", dir, free, minFreeBytes)
+		}
+		return nil
+	}
+}
+
+
+// LogDirDiskSpaceCheck - DiskSpaceCheck of the directory memory logs of the server are persisted to
+func LogDirDiskSpaceCheck(minFreeBytes uint64) HealthCheck {
+	return func(ctx context.Context) error {
+		return DiskSpaceCheck(logFileDir(serverFromContext(ctx)), minFreeBytes)(ctx)
+	}
+}
+
+
+/**************** Running checks **********************/
+
+// run - the outcome of the check, cached or shared with the probes that asked while it was running
+func (c *healthCheck) run(ctx context.Context) checkResult {
+	c.mu.Lock()
+	if c.cacheTTL > 0 && !c.lastRun.IsZero() && time.Since(c.lastRun) < c.cacheTTL {
+		res := c.last
+		c.mu.Unlock()
+		res.Cached = true
+		return res
+	}
+	if running := c.running; running != nil {
+		c.mu.Unlock()
+		<-running
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.last
+	}
+	running := make(chan struct{})
+	c.running = running
+	c.mu.Unlock()
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	err := callWithContext(ctx, c.check)
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("timed out after %s", c.timeout)
+	}
+
+	res := checkResult{Status: checkStatusOK, Duration: time.Since(start).String()}
+	if err != nil {
+		res.Status = checkStatusFailed
+		res.Error = err.Error()
+	}
+	c.mu.Lock()
+	c.last = res
+	c.lastRun = time.Now()
+	c.running = nil
+	c.mu.Unlock()
+	close(running)
+	return res
+}
+
+
+// runChecks - runs the checks concurrently, true if all passed
+func runChecks(ctx context.Context, checks []*healthCheck) (map[string]checkResult, bool) {
+	results := make(map[string]checkResult, len(checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c *healthCheck) {
+			defer wg.Done()
+			res := c.run(ctx)
+			mu.Lock()
+			results[c.name] = res
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+	ok := true
+	for _, res := range results {
+		if res.Status != checkStatusOK {
+			ok = false
+		}
+	}
+	return results, ok
+}
+
+
+// notReadyReason - why the server is not serving traffic regardless of its checks, "" if it is
+func notReadyReason(server *NicoServer) string {
+	switch {
+		case atomic.LoadInt32(&server.draining) == 1:
+			return "draining"
+		case atomic.LoadInt32(&server.suspended) == 1:
+			return "suspended"
+		case atomic.LoadInt32(&server.healthy) == 0:
+			return "not started"
+	}
+	return ""
+}
+
+
+func (h *NicoServer) livez(w http.ResponseWriter, r *http.Request) {
+	results, ok := runChecks(contextWithServer(r.Context(), h), h.livenessChecks)
+	writeHealthReport(w, r, healthReport{Checks: results}, ok)
+}
+
+
+func (h *NicoServer) readyz(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{Reason: notReadyReason(h)}
+	results, ok := runChecks(contextWithServer(r.Context(), h), h.readinessChecks)
+	report.Checks = results
+	writeHealthReport(w, r, report, ok && report.Reason == "")
+}
+
+
+func writeHealthReport(w http.ResponseWriter, r *http.Request, report healthReport, ok bool) {
+	code := http.StatusOK
+	report.Status = checkStatusOK
+	if !ok {
+		code = http.StatusServiceUnavailable
+		report.Status = checkStatusFailed
+	}
+	if _, verbose := r.URL.Query()["verbose"]; !verbose {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		fmt.Fprintln(w, report.Status)
+		return
+	}
+	js, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		WriteProblem(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(js)
+}
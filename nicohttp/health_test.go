@@ -0,0 +1,114 @@
+package nicohttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+
+func probe(h http.HandlerFunc, uri string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, uri, nil))
+	return rec
+}
+
+
+func TestReadyzChecks(t *testing.T) {
+	var dbErr error
+	runs := 0
+	b := GetBuilder().WithDefaults().
+		WithReadinessCheck("db", func(ctx context.Context) error { runs++; return dbErr }, CheckCacheTTL(time.Hour)).
+		WithReadinessCheck("slow", func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() }, CheckTimeout(10*time.Millisecond))
+	b.server.healthy = 1
+
+	rec := probe(b.server.readyz, "/readyz?verbose")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("%s: expected 503 with a timed out check, actual = %d", t.Name(), rec.Code)
+	}
+	var report healthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if report.Checks["db"].Status != checkStatusOK || report.Checks["slow"].Status != checkStatusFailed {
+		t.Fatalf("%s: unexpected breakdown %+v", t.Name(), report)
+	}
+
+	dbErr = errors.New("down")
+	probe(b.server.readyz, "/readyz")
+	if runs != 1 {
+		t.Fatalf("%s: cached check ran %d times", t.Name(), runs)
+	}
+}
+
+
+func TestReadyzSuspendAndDrain(t *testing.T) {
+	b := GetBuilder().WithDefaults()
+	if rec := probe(b.server.readyz, "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("%s: not started server must not be ready, actual = %d", t.Name(), rec.Code)
+	}
+	b.server.healthy = 1
+	if rec := probe(b.server.readyz, "/readyz"); rec.Code != http.StatusOK || rec.Body.String() != "ok\n" {
+		t.Fatalf("%s: expected ready, actual = %d %q", t.Name(), rec.Code, rec.Body.String())
+	}
+	for _, state := range []*int32{&b.server.suspended, &b.server.draining} {
+		*state = 1
+		if rec := probe(b.server.readyz, "/readyz"); rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("%s: expected not ready, actual = %d", t.Name(), rec.Code)
+		}
+		if rec := probe(b.server.livez, "/livez"); rec.Code != http.StatusOK {
+			t.Fatalf("%s: liveness must not follow readiness, actual = %d", t.Name(), rec.Code)
+		}
+		*state = 0
+	}
+}
+
+
+func TestDiskSpaceCheck(t *testing.T) {
+	if err := DiskSpaceCheck(t.TempDir(), 1)(context.Background()); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if err := DiskSpaceCheck(t.TempDir(), 1<<62)(context.Background()); err == nil {
+		t.Fatalf("%s: expected insufficient space", t.Name())
+	}
+}
+
+
+func TestHealthCheckSharedRun(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	c := newHealthCheck("db", func(ctx context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return nil
+	}, nil)
+
+	results := make(chan checkResult, 2)
+	for i := 0; i < 2; i++ {
+		go func() { results <- c.run(context.Background()) }()
+	}
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	/* let the second probe reach the running check */
+	time.Sleep(20 * time.Millisecond)
+	/* the lock is not held while the check runs */
+	if !c.mu.TryLock() {
+		t.Fatalf("%s: lock held while the check runs", t.Name())
+	}
+	c.mu.Unlock()
+	close(release)
+	for i := 0; i < 2; i++ {
+		if res := <-results; res.Status != checkStatusOK {
+			t.Fatalf("%s: %+v", t.Name(), res)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("%s: check ran %d times for concurrent probes, expected once", t.Name(), calls)
+	}
+}
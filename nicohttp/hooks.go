@@ -0,0 +1,186 @@
+package nicohttp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHookTimeout time.Duration = 30 * time.Second
+)
+
+// LifecycleHook - extension point run on a lifecycle transition of the service, e.g. opening a
+// DB pool on start and closing it on shutdown
+type LifecycleHook func(ctx context.Context) error
+
+// HookOption - optional behaviour of a lifecycle hook
+type HookOption func(h *lifecycleHook)
+
+type hookPhase int
+const (
+	startPhase hookPhase = iota
+	readyPhase
+	suspendPhase
+	restartPhase
+	shutdownPhase
+)
+
+type lifecycleHook struct {
+	name string
+	hook LifecycleHook
+	timeout time.Duration
+}
+
+
+// HookTimeout - the hook fails if it has not returned within d. Default is 30s
+func HookTimeout(d time.Duration) HookOption {
+	return func(h *lifecycleHook) {
+		h.timeout = d
+	}
+}
+
+
+// OnStart - hook run before the service starts listening. Hooks run in registration order and
+// the first error aborts startup
+func (b *NicoBuilder) OnStart(name string, hook LifecycleHook, opts ...HookOption) (*NicoBuilder) {
+	b.server.OnStart(name, hook, opts...)
+	return b
+}
+
+
+// OnReady - hook run once the service is listening. Hooks run in registration order and the
+// first error aborts startup
+func (b *NicoBuilder) OnReady(name string, hook LifecycleHook, opts ...HookOption) (*NicoBuilder) {
+	b.server.OnReady(name, hook, opts...)
+	return b
+}
+
+
+// OnSuspend - hook run by /suspend once the service stopped serving its API
+func (b *NicoBuilder) OnSuspend(name string, hook LifecycleHook, opts ...HookOption) (*NicoBuilder) {
+	b.server.OnSuspend(name, hook, opts...)
+	return b
+}
+
+
+// OnRestart - hook run by /restart before the service serves its API again. The service stays
+// suspended if a hook fails
+func (b *NicoBuilder) OnRestart(name string, hook LifecycleHook, opts ...HookOption) (*NicoBuilder) {
+	b.server.OnRestart(name, hook, opts...)
+	return b
+}
+
+
+// OnShutdown - hook run on shutdown once in flight requests have drained, and when startup is
+// aborted. Hooks run in reverse registration order, releasing resources in the reverse order
+// they were acquired
+func (b *NicoBuilder) OnShutdown(name string, hook LifecycleHook, opts ...HookOption) (*NicoBuilder) {
+	b.server.OnShutdown(name, hook, opts...)
+	return b
+}
+
+
+// OnStart - see NicoBuilder.OnStart
+func (h *NicoServer) OnStart(name string, hook LifecycleHook, opts ...HookOption) (*NicoServer) {
+	return h.addHook(startPhase, name, hook, opts)
+}
+
+
+// OnReady - see NicoBuilder.OnReady
+func (h *NicoServer) OnReady(name string, hook LifecycleHook, opts ...HookOption) (*NicoServer) {
+	return h.addHook(readyPhase, name, hook, opts)
+}
+
+
+// OnSuspend - see NicoBuilder.OnSuspend
+func (h *NicoServer) OnSuspend(name string, hook LifecycleHook, opts ...HookOption) (*NicoServer) {
+	return h.addHook(suspendPhase, name, hook, opts)
+}
+
+
+// OnRestart - see NicoBuilder.OnRestart
+func (h *NicoServer) OnRestart(name string, hook LifecycleHook, opts ...HookOption) (*NicoServer) {
+	return h.addHook(restartPhase, name, hook, opts)
+}
+
+
+// OnShutdown - see NicoBuilder.OnShutdown
+func (h *NicoServer) OnShutdown(name string, hook LifecycleHook, opts ...HookOption) (*NicoServer) {
+	return h.addHook(shutdownPhase, name, hook, opts)
+}
+
+
+func (h *NicoServer) addHook(phase hookPhase, name string, hook LifecycleHook, opts []HookOption) (*NicoServer) {
+	defer h.builder.mu.Unlock()
+	h.builder.mu.Lock()
+	lh := lifecycleHook{name: name, hook: hook, timeout: defaultHookTimeout}
+	for _, opt := range opts {
+		opt(&lh)
+	}
+	if h.hooks == nil {
+		h.hooks = make(map[hookPhase][]lifecycleHook)
+	}
+	h.hooks[phase] = append(h.hooks[phase], lh)
+
+	registered := make(map[string]string)
+	for p, hooks := range h.hooks {
+		names := make([]string, 0, len(hooks))
+		for _, hk := range hooks {
+			names = append(names, hk.name)
+		}
+		registered[p.String()] = strings.Join(names, ",")
+	}
+	h.builder.props[LifecycleHooksKey] = registered
+	return h
+}
+
+
+// runHooks - runs the hooks of a phase, each bounded by its timeout and ctx, logging outcomes.
+// Startup phases stop at the first error, the others run every hook and return the first error
+func runHooks(ctx context.Context, server *NicoServer, phase hookPhase) error {
+	server.builder.mu.Lock()
+	hooks := append([]lifecycleHook(nil), server.hooks[phase]...)
+	server.builder.mu.Unlock()
+
+	var first error
+	for i := range hooks {
+		hook := hooks[i]
+		if phase == shutdownPhase {
+			hook = hooks[len(hooks)-1-i]
+		}
+		hctx, cancel := context.WithTimeout(ctx, hook.timeout)
+		start := time.Now()
+		err := callWithContext(hctx, hook.hook)
+		cancel()
+		if err == nil {
+			server.logger.Printf("%s hook %s completed in %s\n", phase, hook.name, time.Since(start))
+			continue
+		}
+		server.logger.Printf("%s hook %s failed after %s: %s\n", phase, hook.name, time.Since(start), err)
+		err = fmt.Errorf("%s hook %s: %w", phase, hook.name, err)
+		if phase == startPhase || phase == readyPhase {
+			return err
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+
+// callWithContext - calls f, giving up when ctx is done even if f does not honour it
+func callWithContext(ctx context.Context, f func(ctx context.Context) error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f(ctx)
+	}()
+	select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			return fmt.Errorf("abandoned: %w", ctx.Err())
+	}
+}
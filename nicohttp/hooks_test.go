@@ -0,0 +1,90 @@
+package nicohttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+
+func TestStartHookAbortsStartup(t *testing.T) {
+	var order []string
+	b := GetBuilder().WithDefaults().WithNoMemoryLogger().
+		OnStart("db", func(ctx context.Context) error { order = append(order, "db"); return nil }).
+		OnStart("cache", func(ctx context.Context) error { return errors.New("unreachable") }).
+		OnStart("queue", func(ctx context.Context) error { order = append(order, "queue"); return nil })
+	initBuiltServer(t.Name(), 0, b, &http.Server{})
+
+	err := b.server.startup()
+	if err == nil || !strings.Contains(err.Error(), "OnStart hook cache") {
+		t.Fatalf("%s: expected the cache hook error, actual = %v", t.Name(), err)
+	}
+	if !reflect.DeepEqual(order, []string{"db"}) {
+		t.Fatalf("%s: hooks after the failed one must not run, actual = %v", t.Name(), order)
+	}
+}
+
+
+func TestHookTimeout(t *testing.T) {
+	b := GetBuilder().WithDefaults().
+		OnShutdown("stuck", func(ctx context.Context) error { select {} }, HookTimeout(10*time.Millisecond))
+	start := time.Now()
+	if err := runHooks(context.Background(), b.server, shutdownPhase); err == nil || time.Since(start) > time.Second {
+		t.Fatalf("%s: expected the hook to be abandoned after its timeout, err = %v", t.Name(), err)
+	}
+}
+
+
+func TestRestartHookKeepsSuspended(t *testing.T) {
+	var restartErr error
+	suspended := false
+	b := GetBuilder().WithDefaults().
+		OnSuspend("pause", func(ctx context.Context) error { suspended = true; return nil }).
+		OnRestart("resume", func(ctx context.Context) error { return restartErr })
+
+	rec := httptest.NewRecorder()
+	b.server.suspend(rec, httptest.NewRequest(http.MethodPost, "/suspend", nil))
+	if rec.Code != http.StatusNoContent || !suspended {
+		t.Fatalf("%s: suspend hook not run, status = %d", t.Name(), rec.Code)
+	}
+
+	restartErr = errors.New("db unreachable")
+	rec = httptest.NewRecorder()
+	b.server.restart(rec, httptest.NewRequest(http.MethodPost, "/restart", nil))
+	if rec.Code != http.StatusInternalServerError || b.server.suspended != 1 {
+		t.Fatalf("%s: failed restart hook must keep the service suspended, status = %d", t.Name(), rec.Code)
+	}
+
+	restartErr = nil
+	rec = httptest.NewRecorder()
+	b.server.restart(rec, httptest.NewRequest(http.MethodPost, "/restart", nil))
+	if rec.Code != http.StatusNoContent || b.server.suspended != 0 {
+		t.Fatalf("%s: expected restart, status = %d", t.Name(), rec.Code)
+	}
+}
+
+
+func TestFailedSuspendHookKeepsServing(t *testing.T) {
+	var suspendErr error
+	b := GetBuilder().WithDefaults().
+		OnSuspend("drain", func(ctx context.Context) error { return suspendErr })
+
+	suspendErr = errors.New("drain failed")
+	rec := httptest.NewRecorder()
+	b.server.suspend(rec, httptest.NewRequest(http.MethodPost, "/suspend", nil))
+	if rec.Code != http.StatusInternalServerError || b.server.suspended != 0 {
+		t.Fatalf("%s: failed suspend hook must leave the service running, status = %d", t.Name(), rec.Code)
+	}
+
+	suspendErr = nil
+	rec = httptest.NewRecorder()
+	b.server.suspend(rec, httptest.NewRequest(http.MethodPost, "/suspend", nil))
+	if rec.Code != http.StatusNoContent || b.server.suspended != 1 {
+		t.Fatalf("%s: expected suspension once the hook succeeds, status = %d", t.Name(), rec.Code)
+	}
+}
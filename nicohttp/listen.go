@@ -0,0 +1,156 @@
+package nicohttp
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultBindAddress string = "0.0.0.0"
+	/* first file descriptor passed by systemd socket activation, sd_listen_fds(3) */
+	listenFdsStart int = 3
+)
+
+
+// WithBindAddress - interface the service listens on, e.g. 127.0.0.1, ::1, :: (all IPv6 and,
+// depending on the OS, IPv4 interfaces) or localhost. Default is 0.0.0.0, -bindAddress overrides
+func (b *NicoBuilder) WithBindAddress(host string) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.props[BindAddressKey] = host
+	return b
+}
+
+
+// WithUnixSocket - listen on the unix domain socket at path instead of a TCP port, e.g. behind a
+// local proxy. A stale socket left by a previous run is removed. -unixSocket overrides
+func (b *NicoBuilder) WithUnixSocket(path string) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.props[UnixSocketKey] = path
+	return b
+}
+
+
+// WithSocketActivation - serve on the socket passed by systemd socket activation (LISTEN_FDS)
+// instead of opening one. Startup fails if systemd passed none. -socketActivation overrides
+func (b *NicoBuilder) WithSocketActivation() (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.props[SocketActivationKey] = true
+	return b
+}
+
+
+// CreateWithListener - Create serving on l rather than opening a listener, e.g. one from
+// net.Listen("tcp", "127.0.0.1:0") in tests. Port() returns the port l listens on
+func (b *NicoBuilder) CreateWithListener(svcName string, l net.Listener) (*NicoServer, error) {
+	port := uint32(0)
+	if a, ok := l.Addr().(*net.TCPAddr); ok {
+		port = uint32(a.Port)
+	}
+	server, err := b.Create(svcName, port)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	server.listener = l
+	server.port = port
+	b.props[ListenPortKey] = port
+	b.mu.Unlock()
+	return server, nil
+}
+
+
+// Addr - the address the service listens on, nil until it is listening
+func (h *NicoServer) Addr() (net.Addr) {
+	defer h.builder.mu.Unlock()
+	h.builder.mu.Lock()
+	if h.listener == nil {
+		return nil
+	}
+	return h.listener.Addr()
+}
+
+
+// started - the time the service started listening, zero until it does
+func (h *NicoServer) started() time.Time {
+	defer h.builder.mu.Unlock()
+	h.builder.mu.Lock()
+	return h.startTime
+}
+
+
+// configureListener - the address s listens on, from the builder options and flags
+func configureListener(b *NicoBuilder, s *http.Server, port uint32) {
+	if b.flagset["bindAddress"] {
+		b.props[BindAddressKey] = b.stringFlag("bindAddress")
+	}
+	if b.flagset["unixSocket"] {
+		b.props[UnixSocketKey] = b.stringFlag("unixSocket")
+	}
+	if b.flagset["socketActivation"] {
+		b.props[SocketActivationKey] = b.boolFlag("socketActivation")
+	}
+	s.Addr = net.JoinHostPort((b.props[BindAddressKey]).(string), strconv.Itoa(int(port)))
+	if path := (b.props[UnixSocketKey]).(string); path != "None" && path != "" {
+		b.server.unixSocket = path
+	}
+	b.server.socketActivation = (b.props[SocketActivationKey]).(bool)
+}
+
+
+// listen - the listener given to CreateWithListener, else the one handed off by an upgrade, the
+// systemd socket, the unix socket or the TCP address of the service
+func (h *NicoServer) listen() (net.Listener, error) {
+	h.builder.mu.Lock()
+	l := h.listener
+	h.builder.mu.Unlock()
+	if l != nil {
+		return l, nil
+	}
+	var err error
+	switch {
+		case h.inherited:
+			l, err = inheritedListener(h.svcName)
+		case h.socketActivation:
+			l, err = systemdListener()
+		case h.unixSocket != "":
+			if fi, serr := os.Stat(h.unixSocket); serr == nil && fi.Mode()&os.ModeSocket != 0 {
+				os.Remove(h.unixSocket)
+			}
+			l, err = net.Listen("unix", h.unixSocket)
+		default:
+			l, err = net.Listen("tcp", h.server.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.builder.mu.Lock()
+	h.listener = l
+	h.builder.mu.Unlock()
+	return l, nil
+}
+
+
+// systemdListener - the first socket passed by systemd, see sd_listen_fds(3)
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("socket activation: no socket passed to this process (LISTEN_PID)")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("socket activation: no socket passed (LISTEN_FDS)")
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	f := os.NewFile(uintptr(listenFdsStart), "LISTEN_FD_3")
+	defer f.Close()
+	return net.FileListener(f)
+}
@@ -0,0 +1,138 @@
+package nicohttp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+
+func TestCreateWithListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	srv, err := GetBuilder().WithDefaults().WithNoMemoryLogger().CreateWithListener(t.Name(), l)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	want := uint32(l.Addr().(*net.TCPAddr).Port)
+	if srv.Port() != want {
+		t.Fatalf("%s: port %d before start, expected %d", t.Name(), srv.Port(), want)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(ctx)
+	}()
+	<-srv.Ready()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if srv.Addr().String() != l.Addr().String() {
+		t.Fatalf("%s: listening at %s, expected %s", t.Name(), srv.Addr(), l.Addr())
+	}
+	resp, err := http.Get(getTarget(srv.Port(), uriHealthz))
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: status %d", t.Name(), resp.StatusCode)
+	}
+}
+
+
+func TestBindAddress(t *testing.T) {
+	srv, _ := GetBuilder().WithDefaults().WithNoMemoryLogger().WithBindAddress("127.0.0.1").
+		Create(t.Name(), 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(ctx)
+	}()
+	<-srv.Ready()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	a, ok := srv.Addr().(*net.TCPAddr)
+	if !ok || !a.IP.IsLoopback() {
+		t.Fatalf("%s: listening at %s, expected the loopback interface", t.Name(), srv.Addr())
+	}
+	if srv.Port() == 0 || srv.Port() != uint32(a.Port) {
+		t.Fatalf("%s: port %d, expected the port picked by the OS %d", t.Name(), srv.Port(), a.Port)
+	}
+	resp, err := http.Get("http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(a.Port)) + uriHealthz)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	resp.Body.Close()
+}
+
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "svc.sock")
+	/* a socket left by a previous run */
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("%s: unix sockets unavailable: %s", t.Name(), err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	srv, _ := GetBuilder().WithDefaults().WithNoMemoryLogger().WithUnixSocket(path).Create(t.Name(), 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(ctx)
+	}()
+	select {
+		case <-srv.Ready():
+		case err := <-done:
+			t.Fatalf("%s: %s", t.Name(), err)
+	}
+
+	if srv.Port() != 0 || srv.Addr().Network() != "unix" {
+		t.Fatalf("%s: listening at %s %s port %d", t.Name(), srv.Addr().Network(), srv.Addr(), srv.Port())
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix" + uriHealthz)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: status %d", t.Name(), resp.StatusCode)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("%s: socket %s not removed on shutdown", t.Name(), path)
+	}
+}
+
+
+func TestSocketActivationWithoutSocket(t *testing.T) {
+	/* restored once the test ends, empty reads as not passed */
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+	srv, _ := GetBuilder().WithDefaults().WithNoMemoryLogger().WithSocketActivation().Create(t.Name(), 0)
+	if err := srv.Run(context.Background()); err == nil {
+		t.Fatalf("%s: expected startup to fail without a socket passed", t.Name())
+	}
+}
@@ -0,0 +1,310 @@
+package nicohttp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	logSpoolSuffix string = ".log.wal"
+	maxSpoolRecordSize int = 1024 * 1024
+	defaultMaxSpoolBytes int64 = 64 * 1024 * 1024
+	/* entries replayed from a spool per snapshot delivered to the sink */
+	spoolReplayBatch int = defaultMemLogSize
+)
+
+var errSpoolFull = errors.New("memory log spool full")
+
+// logSpool - write-ahead file holding every memory log entry that has not yet reached the sink.
+// Each record is a single line "<crc32 hex>\t<json entry>\n" so that a record torn by a crash
+// can be detected and skipped on replay.
+type logSpool struct {
+	path string
+	file *os.File
+	size int64
+	max int64
+	/* offset up to which a dump that failed part way delivered the spool */
+	delivered int64
+}
+
+func logSpoolPath(dir string, svcName string) string {
+	return fmt.Sprintf("%s/%s%s", dir, svcName, logSpoolSuffix)
+}
+
+// openLogSpool - opens (or creates) the spool at path, which takes at most max bytes of entries, no
+// limit if max <= 0. Entries left unflushed by a previous run stay in it until replayed
+func openLogSpool(path string, max int64) (*logSpool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &logSpool{path: path, file: f, size: fi.Size(), max: max}, nil
+}
+
+// replayLogSpool - hands the records of the spool at path from offset on to deliver, in batches of
+// at most batch entries together with the offset following the batch, so that a large spool is
+// never held in memory at once. Returns the number of corrupted records skipped
+func replayLogSpool(path string, offset int64, batch int, deliver func(entries []memoryLogEntry, next int64) error) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var entries []memoryLogEntry
+	corrupted := 0
+	r := bufio.NewReaderSize(f, 64*1024)
+	for {
+		line, err := r.ReadString('\n')
+		if len(line) > 0 {
+			offset += int64(len(line))
+			if le, ok := decodeSpoolRecord(line); ok {
+				entries = append(entries, le)
+			} else {
+				corrupted++
+			}
+		}
+		if err != nil && err != io.EOF {
+			return corrupted, err
+		}
+		if len(entries) > 0 && (len(entries) >= batch || err == io.EOF) {
+			if derr := deliver(entries, offset); derr != nil {
+				return corrupted, derr
+			}
+			entries = nil
+		}
+		if err == io.EOF {
+			return corrupted, nil
+		}
+	}
+}
+
+func encodeSpoolRecord(le *memoryLogEntry) ([]byte, error) {
+	js, err := json.Marshal(le)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%08x\t%s\n", crc32.ChecksumIEEE(js), js)), nil
+}
+
+func decodeSpoolRecord(line string) (memoryLogEntry, bool) {
+	var le memoryLogEntry
+	/* a record without its newline was torn by a crash mid write */
+	if !strings.HasSuffix(line, "\n") || len(line) > maxSpoolRecordSize {
+		return le, false
+	}
+	fields := strings.SplitN(strings.TrimSuffix(line, "\n"), "\t", 2)
+	if len(fields) != 2 {
+		return le, false
+	}
+	sum, err := strconv.ParseUint(fields[0], 16, 32)
+	if err != nil || uint32(sum) != crc32.ChecksumIEEE([]byte(fields[1])) {
+		return le, false
+	}
+	if err := json.Unmarshal([]byte(fields[1]), &le); err != nil {
+		return le, false
+	}
+	return le, true
+}
+
+// append - spools le, errSpoolFull once the spool holds its maximum size
+func (s *logSpool) append(le *memoryLogEntry) error {
+	rec, err := encodeSpoolRecord(le)
+	if err != nil {
+		return err
+	}
+	if s.max > 0 && s.size + int64(len(rec)) > s.max {
+		return errSpoolFull
+	}
+	n, err := s.file.Write(rec)
+	s.size += int64(n)
+	return err
+}
+
+// reset - discards the spooled entries once they have been delivered to the sink
+func (s *logSpool) reset() error {
+	if err := s.file.Truncate(0); err != nil {
+		return err
+	}
+	s.size, s.delivered = 0, 0
+	_, err := s.file.Seek(0, io.SeekStart)
+	return err
+}
+
+func (s *logSpool) close() error {
+	return s.file.Close()
+}
+
+
+// recoverLogSpool - delivers entries left in the spool by a previous run to the configured sink
+// before the memory logger starts accepting new entries. A process started by an upgrade spools to
+// a file of its own, as the upgraded process still appends to its spool while it drains, and
+// recovers that spool once the upgraded process has exited
+func recoverLogSpool(server *NicoServer) error {
+	path := logSpoolPath(server.spoolDir, server.svcName)
+	if server.inherited {
+		path = fmt.Sprintf("%s.%d", path, os.Getpid())
+	}
+	spool, err := openLogSpool(path, server.spoolMax)
+	if err != nil {
+		return err
+	}
+	server.spool = spool
+	msg, err := deliverLogSpool(server, path, &spool.delivered)
+	if err != nil {
+		/* keep the spool intact, the next dump replays it, or the next start if that fails too */
+		server.spoolBacklog = true
+		return err
+	}
+	if msg != "" {
+		if err := spool.reset(); err != nil {
+			return err
+		}
+		storeLogEntry(server, &memoryLogEntry{TS: time.Now().UnixNano(), LE: msg})
+	}
+	if server.inherited {
+		go recoverSpoolsAfterUpgrade(server)
+		return nil
+	}
+	return recoverOtherLogSpools(server)
+}
+
+
+// recoverOtherLogSpools - delivers the spools of the service other than its own, left by a process
+// that was upgraded or by a process started by an upgrade, and removes them once delivered. A
+// spool that could not be delivered is kept for the next start
+func recoverOtherLogSpools(server *NicoServer) error {
+	own := logSpoolPath(server.spoolDir, server.svcName)
+	paths, err := filepath.Glob(own + "*")
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		pid := strings.TrimPrefix(path, own + ".")
+		if path == server.spool.path || (path != own && (pid == path || strings.Trim(pid, "0123456789") != "")) {
+			continue
+		}
+		/* a spool delivered in part is delivered again from the start by the next start */
+		var delivered int64
+		msg, err := deliverLogSpool(server, path, &delivered)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		if msg != "" {
+			appendLogEntry(server, &memoryLogEntry{TS: time.Now().UnixNano(), LE: msg})
+		}
+	}
+	return nil
+}
+
+
+// recoverSpoolsAfterUpgrade - has the memory logger recover the spool of the upgraded process once
+// it has exited
+func recoverSpoolsAfterUpgrade(server *NicoServer) {
+	select {
+		case <-upgradeParentExited():
+		case <-server.stopping:
+			return
+	}
+	done := make(chan error, 1)
+	select {
+		case server.logCmdChan <- logCommand{name: recoverSpoolsCmd, done: done}:
+		case <-server.stopping:
+			return
+	}
+	if err := <-done; err != nil {
+		fmt.Printf("Memory log spool recovery for service %s failed: %s\n", server.svcName, err)
+	}
+}
+
+
+// deliverLogSpool - dumps the entries of the spool at path from *delivered on to the sink, a
+// snapshot per batch, advancing *delivered past each batch that reached it. Returns "" if there
+// were none, else the memory log entry recording the recovery
+func deliverLogSpool(server *NicoServer, path string, delivered *int64) (string, error) {
+	entries, written := 0, 0
+	corrupted, err := replayLogSpool(path, *delivered, spoolReplayBatch, func(batch []memoryLogEntry, next int64) error {
+		server.snapshotID++
+		n, err := dumpLogEntries(server, batch)
+		recordDump(server, err)
+		if err != nil {
+			return err
+		}
+		entries += len(batch)
+		written += n
+		*delivered = next
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if entries == 0 && corrupted == 0 {
+		return "", nil
+	}
+	msg := fmt.Sprintf("Recovered memory log spool %s: snapshotID=%d, entries=%d, corrupted=%d, bytesWritten=%d",
+		filepath.Base(path), server.snapshotID, entries, corrupted, written)
+	fmt.Println(msg)
+	return msg, nil
+}
+
+
+// dumpLogSpool - delivers the backlog of the spool, the entries of the memory log included, to the
+// sink a snapshot per batch. A failed dump leaves the batches delivered out of the next one, the
+// spool is reset once all of it reached the sink
+func dumpLogSpool(server *NicoServer) (int, error) {
+	spool := server.spool
+	written := 0
+	first := true
+	_, err := replayLogSpool(spool.path, spool.delivered, spoolReplayBatch, func(batch []memoryLogEntry, next int64) error {
+		if !first {
+			server.snapshotID++
+		}
+		first = false
+		n, err := dumpLogEntries(server, batch)
+		written += n
+		if err != nil {
+			return err
+		}
+		spool.delivered = next
+		return nil
+	})
+	recordDump(server, err)
+	if err != nil {
+		return written, err
+	}
+	server.spoolBacklog = false
+	return written, spool.reset()
+}
+
+
+// recordSpoolError - counts an entry the spool could not take, full or failing to write
+func recordSpoolError(server *NicoServer, err error) {
+	if errors.Is(err, errSpoolFull) {
+		server.serverMetrics.spoolDropped.Inc()
+	} else {
+		server.serverMetrics.spoolWriteErrors.Inc()
+	}
+}
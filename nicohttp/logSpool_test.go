@@ -0,0 +1,336 @@
+package nicohttp
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+
+// spooledEntries - the entries of the spool at path, replayed in a single batch
+func spooledEntries(t *testing.T, path string) ([]memoryLogEntry, int) {
+	var entries []memoryLogEntry
+	corrupted, err := replayLogSpool(path, 0, math.MaxInt32, func(batch []memoryLogEntry, next int64) error {
+		entries = append(entries, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	return entries, corrupted
+}
+
+
+func TestLogSpoolReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool"+logSpoolSuffix)
+	spool, err := openLogSpool(path, 0)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if recovered, corrupted := spooledEntries(t, path); len(recovered) != 0 || corrupted != 0 {
+		t.Fatalf("%s: new spool recovered %d entries, %d corrupted", t.Name(), len(recovered), corrupted)
+	}
+	for i := 0; i < 3; i++ {
+		if err := spool.append(&memoryLogEntry{ID: i, TS: int64(i), LE: "entry"}); err != nil {
+			t.Fatalf("%s: %s", t.Name(), err)
+		}
+	}
+	spool.close()
+
+	recovered, corrupted := spooledEntries(t, path)
+	if len(recovered) != 3 || corrupted != 0 {
+		t.Fatalf("%s: expected 3 recovered entries, actual = %d, corrupted = %d", t.Name(), len(recovered), corrupted)
+	}
+}
+
+
+func TestLogSpoolReplayCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool"+logSpoolSuffix)
+	good, _ := encodeSpoolRecord(&memoryLogEntry{ID: 0, TS: 1, LE: "good"})
+	bad, _ := encodeSpoolRecord(&memoryLogEntry{ID: 1, TS: 2, LE: "flipped"})
+	bad[12] ^= 0xff
+	torn, _ := encodeSpoolRecord(&memoryLogEntry{ID: 2, TS: 3, LE: "torn"})
+	torn = torn[:len(torn)-5]
+
+	data := append(append(append([]byte{}, good...), bad...), good...)
+	data = append(data, torn...)
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+
+	recovered, corrupted := spooledEntries(t, path)
+	if len(recovered) != 2 || corrupted != 2 {
+		t.Fatalf("%s: expected 2 recovered and 2 corrupted, actual = %d, %d", t.Name(), len(recovered), corrupted)
+	}
+	if recovered[0].LE != "good" {
+		t.Fatalf("%s: unexpected entry %v", t.Name(), recovered[0])
+	}
+}
+
+
+func TestLogSpoolReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool"+logSpoolSuffix)
+	spool, err := openLogSpool(path, 0)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	spool.append(&memoryLogEntry{ID: 0, TS: 1, LE: "flushed"})
+	if err := spool.reset(); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	spool.append(&memoryLogEntry{ID: 0, TS: 2, LE: "pending"})
+	spool.close()
+
+	recovered, _ := spooledEntries(t, path)
+	if len(recovered) != 1 || recovered[0].LE != "pending" {
+		t.Fatalf("%s: expected only the pending entry, actual = %v", t.Name(), recovered)
+	}
+}
+
+
+// sinkContents - everything the FILE sink wrote for svcName in dir
+func sinkContents(t *testing.T, dir, svcName string) string {
+	files, err := filepath.Glob(filepath.Join(dir, svcName + ".log.*"))
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	var sb strings.Builder
+	for _, f := range files {
+		if strings.Contains(f, logSpoolSuffix) {
+			continue
+		}
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("%s: %s", t.Name(), err)
+		}
+		sb.Write(data)
+	}
+	return sb.String()
+}
+
+
+func TestLogSpoolRecoveredOnRun(t *testing.T) {
+	dir := t.TempDir()
+	/* the spool a crashed process left behind */
+	spool, err := openLogSpool(logSpoolPath(dir, t.Name()), 0)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	spool.append(&memoryLogEntry{ID: 0, TS: 1, LE: "logged before the crash"})
+	spool.append(&memoryLogEntry{ID: 1, TS: 2, LE: "last words"})
+	spool.close()
+
+	srv, _ := GetBuilder().WithDefaults().WithoutStdLog().WithLogSink(FILE).WithLogSpool(dir).
+		Create(t.Name(), getLoggerPort())
+	srv.logDir = dir
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(ctx)
+	}()
+	<-srv.Ready()
+	if sink := sinkContents(t, dir, t.Name()); !strings.Contains(sink, "logged before the crash") ||
+		!strings.Contains(sink, "last words") {
+		t.Fatalf("%s: spooled entries not recovered to the sink: %s", t.Name(), sink)
+	}
+	srv.Logger().Printf("logged after the recovery")
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if sink := sinkContents(t, dir, t.Name()); !strings.Contains(sink, "logged after the recovery") {
+		t.Fatalf("%s: final flush missing: %s", t.Name(), sink)
+	}
+	if recovered, _ := spooledEntries(t, logSpoolPath(dir, t.Name())); len(recovered) != 0 {
+		t.Fatalf("%s: spool not reset after the final flush: %v", t.Name(), recovered)
+	}
+}
+
+
+func TestLogSpoolRecoversUpgradeSpools(t *testing.T) {
+	dir := t.TempDir()
+	/* the spool of a process started by an upgrade that has since exited, and a file it must leave */
+	path := logSpoolPath(dir, t.Name()) + ".4242"
+	spool, err := openLogSpool(path, 0)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	spool.append(&memoryLogEntry{ID: 0, TS: 1, LE: "logged by the upgraded process"})
+	spool.close()
+	backup := logSpoolPath(dir, t.Name()) + ".bak"
+	if err := os.WriteFile(backup, nil, 0666); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+
+	srv, _ := GetBuilder().WithDefaults().WithoutStdLog().WithLogSink(FILE).WithLogSpool(dir).
+		Create(t.Name(), getLoggerPort())
+	srv.logDir = dir
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(ctx)
+	}()
+	<-srv.Ready()
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if sink := sinkContents(t, dir, t.Name()); !strings.Contains(sink, "logged by the upgraded process") {
+		t.Fatalf("%s: upgrade spool not recovered to the sink: %s", t.Name(), sink)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("%s: recovered upgrade spool not removed: %v", t.Name(), err)
+	}
+	if _, err := os.Stat(backup); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+}
+
+
+func TestFailedDumpKeepsEntries(t *testing.T) {
+	for _, spooled := range []bool{true, false} {
+		dir := t.TempDir()
+		svcName := fmt.Sprintf("%s-%t", t.Name(), spooled)
+		b := GetBuilder().WithDefaults().WithoutStdLog().WithLogSink(FILE)
+		if spooled {
+			b = b.WithLogSpool(dir)
+		}
+		srv, _ := b.Create(svcName, getLoggerPort())
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- srv.Run(ctx)
+		}()
+		<-srv.Ready()
+
+		srv.logDir = filepath.Join(dir, "missing")
+		srv.Logger().Printf("written while the sink fails")
+		if err := flushMemoryLog(context.Background(), srv); err == nil {
+			t.Fatalf("%s: expected the dump to a missing directory to fail", svcName)
+		}
+		srv.Logger().Printf("written once the sink is back")
+		srv.logDir = dir
+		if err := flushMemoryLog(context.Background(), srv); err != nil {
+			t.Fatalf("%s: %s", svcName, err)
+		}
+		sink := sinkContents(t, dir, svcName)
+		if !strings.Contains(sink, "written while the sink fails") || !strings.Contains(sink, "written once the sink is back") {
+			t.Fatalf("%s: entries lost after a failed dump: %s", svcName, sink)
+		}
+		cancel()
+		<-done
+	}
+}
+
+
+func TestLogSpoolLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool"+logSpoolSuffix)
+	rec, _ := encodeSpoolRecord(&memoryLogEntry{ID: 0, TS: 1, LE: "entry"})
+	spool, err := openLogSpool(path, int64(2*len(rec)))
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := spool.append(&memoryLogEntry{ID: 0, TS: 1, LE: "entry"}); err != nil {
+			t.Fatalf("%s: %s", t.Name(), err)
+		}
+	}
+	if err := spool.append(&memoryLogEntry{ID: 0, TS: 1, LE: "entry"}); err != errSpoolFull {
+		t.Fatalf("%s: expected %v, actual = %v", t.Name(), errSpoolFull, err)
+	}
+	spool.close()
+
+	/* the size of the spool a previous run left counts towards the limit */
+	spool, err = openLogSpool(path, int64(2*len(rec)))
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if err := spool.append(&memoryLogEntry{ID: 0, TS: 1, LE: "entry"}); err != errSpoolFull {
+		t.Fatalf("%s: expected %v on reopen, actual = %v", t.Name(), errSpoolFull, err)
+	}
+	if err := spool.reset(); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if err := spool.append(&memoryLogEntry{ID: 0, TS: 1, LE: "entry"}); err != nil {
+		t.Fatalf("%s: %s after a reset", t.Name(), err)
+	}
+	spool.close()
+}
+
+
+func TestLogSpoolReplayBatches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool"+logSpoolSuffix)
+	spool, err := openLogSpool(path, 0)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	for i := 0; i < 5; i++ {
+		spool.append(&memoryLogEntry{ID: i, TS: int64(i), LE: fmt.Sprintf("entry %d", i)})
+	}
+	spool.close()
+
+	/* a replay failing at the second batch resumes from the offset of the first */
+	var offset int64
+	sizes := []int{}
+	errSink := fmt.Errorf("sink down")
+	_, err = replayLogSpool(path, 0, 2, func(batch []memoryLogEntry, next int64) error {
+		if len(sizes) == 1 {
+			return errSink
+		}
+		sizes = append(sizes, len(batch))
+		offset = next
+		return nil
+	})
+	if err != errSink {
+		t.Fatalf("%s: expected %v, actual = %v", t.Name(), errSink, err)
+	}
+	var resumed []memoryLogEntry
+	_, err = replayLogSpool(path, offset, 2, func(batch []memoryLogEntry, next int64) error {
+		sizes = append(sizes, len(batch))
+		resumed = append(resumed, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if fmt.Sprint(sizes) != "[2 2 1]" || len(resumed) != 3 || resumed[0].LE != "entry 2" {
+		t.Fatalf("%s: unexpected batches %v, resumed = %v", t.Name(), sizes, resumed)
+	}
+}
+
+
+func TestLogSpoolErrorsCounted(t *testing.T) {
+	dir := t.TempDir()
+	srv, _ := GetBuilder().WithDefaults().WithoutStdLog().WithLogSink(FILE).WithLogSpool(dir).
+		WithLogSpoolLimit(1).Create(t.Name(), getLoggerPort())
+	srv.logDir = dir
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(ctx)
+	}()
+	<-srv.Ready()
+	srv.Logger().Printf("too large for the spool")
+	if err := flushMemoryLog(context.Background(), srv); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	/* an entry the spool could not take still reaches the sink from the memory log */
+	if sink := sinkContents(t, dir, t.Name()); !strings.Contains(sink, "too large for the spool") {
+		t.Fatalf("%s: entry lost: %s", t.Name(), sink)
+	}
+	var sb strings.Builder
+	srv.metrics.Expose(&sb)
+	if !strings.Contains(sb.String(), metricsNamespace+"_memory_log_spool_dropped_total") ||
+		strings.Contains(sb.String(), metricsNamespace+"_memory_log_spool_dropped_total 0\n") {
+		t.Fatalf("%s: dropped entries not counted: %s", t.Name(), sb.String())
+	}
+	if !strings.Contains(sb.String(), metricsNamespace+"_memory_log_spool_write_errors_total 0") {
+		t.Fatalf("%s: spool write errors missing: %s", t.Name(), sb.String())
+	}
+	cancel()
+	<-done
+}
@@ -1,19 +1,21 @@
 package nicohttp
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"log"
 	"net/http"
+	"runtime/debug"
 	"strings"
 	"sync/atomic"
 	"time"
 )
 
-func suspendMediator(next http.Handler) http.Handler {
+func (h *NicoServer) suspendMediator(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if (atomic.LoadInt32(&builder.server.suspended) == 1) && !isBase(r.RequestURI) {
-			http.Error(w, "Temporarily Suspended", http.StatusServiceUnavailable)
+		if (atomic.LoadInt32(&h.suspended) == 1) && !isBase(r.RequestURI) {
+			WriteProblem(w, r, http.StatusServiceUnavailable, "temporarily suspended")
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -25,30 +27,28 @@ func httpBasicAuthMediator(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		hdr := r.Header.Get("Authorization")
 		if hdr == "" {
-			http.Error(w, "Forbidden", http.StatusForbidden)
+			WriteProblem(w, r, http.StatusForbidden, "missing Authorization header")
 			return
 		}
 		splits := strings.Fields(hdr)
-		if !strings.EqualFold(splits[0], "BASIC") {
-			http.Error(w, "Forbidden", http.StatusForbidden)
+		if len(splits) != 2 || !strings.EqualFold(splits[0], "BASIC") {
+			WriteProblem(w, r, http.StatusForbidden, "Authorization header is not Basic")
 			return
 		}
 		b64d, err := base64.StdEncoding.DecodeString(splits[1])
 		if err != nil {
-			http.Error(w, "Forbidden", http.StatusForbidden)
+			WriteProblem(w, r, http.StatusForbidden, "malformed Basic credentials")
 			return
 		}
 		user := strings.Split(string(b64d), ":")[0]
-		r.Header.Add("X-AUTH-USER", user)
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, authenticated(r, user))
 	})
 }
 
 func noAuthMediator(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := "anonymous"
-		r.Header.Add("X-AUTH-USER", user)
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, authenticated(r, user))
 	})
 }
 
@@ -56,8 +56,7 @@ func noAuthMediator(next http.Handler) http.Handler {
 func hmacJWTMediator(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := "hmac-jwt"
-		r.Header.Add("X-AUTH-USER", user)
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, authenticated(r, user))
 	})
 }
 
@@ -65,8 +64,7 @@ func hmacJWTMediator(next http.Handler) http.Handler {
 func rsaJWTMediator(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := "rsa-jwt"
-		r.Header.Add("X-AUTH-USER", user)
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, authenticated(r, user))
 	})
 }
 
@@ -74,8 +72,7 @@ func rsaJWTMediator(next http.Handler) http.Handler {
 func ldapMediator(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := "ldap-user"
-		r.Header.Add("X-AUTH-USER", user)
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, authenticated(r, user))
 	})
 }
 
@@ -111,52 +108,103 @@ func (w *statusResponseWriter) Write(b []byte) (int, error) {
 	return n, err	
 }
 
-func memoryPostLoggingMediator(next http.Handler) http.Handler {
+// Flush - lets streaming handlers flush through the mediators
+func (w *statusResponseWriter) Flush() {
+	if w.status == 0 {
+		w.status = 200
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap - the wrapped writer, for http.ResponseController
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (h *NicoServer) memoryPostLoggingMediator(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
+		start := time.Now()
 		sw := statusResponseWriter{ResponseWriter: w}
-		next.ServeHTTP(&sw, r)
-		user := r.Header.Get("X-AUTH-USER")
-		if user == "" || user == "anonymous" {
-			user = r.Header.Get("X-Goog-Authenticated-User-Email")
-			if user == "" {
-				user = r.Header.Get("X-CHARIOT-USER")
-				if user == "" {
-					user = "anonymous"
-				}
-			}
+		var body *countingReadCloser
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &countingReadCloser{ReadCloser: r.Body}
+			r.Body = body
 		}
-		if r.RequestURI == "/healthz" || strings.HasPrefix(r.RequestURI, "/logs") {
+		next.ServeHTTP(&sw, r)
+		duration := time.Since(start)
+
+		alc := &h.accessLog
+		if alc.excluded(r.URL.Path) {
 			return
 		}
-		sc := sw.status
-		cl := sw.length
-		msg := fmt.Sprintf("Request: requestID=%s, user=%s, remoteAddr=%s, %s %s ; Response: status=%d, CT=%s, CL=%d",
-			r.Header.Get("X-Request-ID"),user, r.RemoteAddr, r.Method, r.RequestURI, sc, w.Header().Get("Content-Type"), cl)
-		builder.server.logChan <- msg
+		rec := accessLogRecord{
+			start: start,
+			requestID: r.Header.Get(requestIDHeader),
+			user: authenticatedUser(r),
+			remoteAddr: r.RemoteAddr,
+			method: r.Method,
+			uri: r.RequestURI,
+			proto: r.Proto,
+			status: sw.status,
+			contentType: w.Header().Get("Content-Type"),
+			bytesOut: sw.length,
+			duration: duration,
+			referer: r.Referer(),
+			userAgent: r.UserAgent(),
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if body != nil {
+			rec.bytesIn = body.n
+		}
+		if alc.format != DEFAULTLOG {
+			rec.route = routeName(h.httpRouter, r)
+		}
+		emitLogEntry(h, alc.render(&rec))
 	})
 }
 
 
-func timeoutMediator(next http.Handler) http.Handler {
-	return http.TimeoutHandler(next, builder.server.handlerTimeout, "timed out")
-}
-
-
-
-func tracingMediator(next http.Handler) http.Handler {
+// panicFlushMediator - best-effort flush of the memory log when a handler panics, so the entries
+// leading up to the panic reach the sink even if the process does not survive it
+func (h *NicoServer) panicFlushMediator(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		requestID := r.Header.Get("X-Request-ID")
-		if requestID == "" {
-			requestID = fmt.Sprintf("%d", time.Now().UnixNano())
-			//ctx := context.WithValue(r.Context(), requestIDKey, requestID)
-			r.Header.Set("X-Request-Id", requestID)
-		}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err != http.ErrAbortHandler && atomic.LoadUint32(&h.logChanState) == 1 {
+				emitLogEntry(h, fmt.Sprintf("panic serving %s %s: %v\n%s", r.Method, r.RequestURI, err, debug.Stack()))
+				flushAfterPanic(h)
+				/* already logged with its stack, abort the connection without logging it again */
+				panic(http.ErrAbortHandler)
+			}
+			panic(err)
+		}()
 		next.ServeHTTP(w, r)
 	})
 }
 
 
+// flushAfterPanic - best-effort flush of the memory log once a panic has been logged, bounded by
+// the shutdown timeout
+func flushAfterPanic(h *NicoServer) {
+	if atomic.LoadUint32(&h.logChanState) != 1 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.shutdownWait)
+	defer cancel()
+	if err := flushMemoryLog(ctx, h); err != nil {
+		fmt.Printf("Memory log flush after panic failed: %s\n", err)
+	}
+}
+
+
 /*
 func initRateLimiting() {
 	store, err := memstore.New(65536)
@@ -1,6 +1,7 @@
 package nicohttp
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"time"
 	"strings"
+	"sync/atomic"
 )
 
 type memoryLogEntry struct {
@@ -16,19 +18,36 @@ type memoryLogEntry struct {
 	LE string
 }
 
+// logCommand - request to the memory logger, done (if not nil) receives the outcome
+type logCommand struct {
+	name string
+	done chan error
+}
+
 const (
 	defaultMemLogSize int = 5000
 	dumpLogCmd string = "_DUMPLOG_"
+	flushLogCmd string = "_FLUSHLOG_"
+	recoverSpoolsCmd string = "_RECOVERSPOOLS_"
 	defaultLogChannelSleep time.Duration = 50 * time.Millisecond
 )
 
 
 func entryBoundMemoryLogger(server *NicoServer) {
-	fmt.Printf("Starting entry bound memory logger ..... max entries = %d\n", server.memLogSize)
+	fmt.Printf("Starting entry bound memory logger ..... max entries = %d, max bytes = %d, flush interval = %s\n",
+		server.memLogSize, server.logBytesQoS, server.logFlushInterval)
+	scheduleNextFlush(server)
 
 	quitLogger:
 
 	for {
+		if server.logFlushInterval > 0 && time.Now().UnixNano() >= atomic.LoadInt64(&server.nextFlushTime) {
+			if server.pendingLogEntries > 0 {
+				rotateMemoryLog(server, "Periodic memory log flush")
+			} else {
+				scheduleNextFlush(server)
+			}
+		}
 		select {
 			case msg, open := <-server.logChan :
 				if open {
@@ -37,19 +56,18 @@ func entryBoundMemoryLogger(server *NicoServer) {
 					continue
 				}
 				break quitLogger
-			case msg, open := <-server.logCmdChan :
+			case cmd, open := <-server.logCmdChan :
 				if open {
-					if strings.EqualFold(msg, dumpLogCmd) {
-						server.snapshotID++
-						n, err := dumpMemoryLog(server)
-						server.evictedLogSize += server.nextLogID
-						s := fmt.Sprintf("API Driven memory log dump: snapshotID=%d, entries=%d, bytesWritten=%d, error=%s", 
-													server.snapshotID, server.nextLogID, n, err)
-						server.nextLogID = 0
-						e := memoryLogEntry{ID: server.nextLogID, TS: time.Now().UnixNano(), LE: s}
-						server.memLog = make([]memoryLogEntry, server.memLogSize, server.memLogSize)
-						server.memLog[server.nextLogID] = e
-						server.nextLogID++					
+					var err error
+					if strings.EqualFold(cmd.name, dumpLogCmd) {
+						err = rotateMemoryLog(server, "API Driven memory log dump")
+					} else if strings.EqualFold(cmd.name, flushLogCmd) && undeliveredLogs(server) {
+						err = rotateMemoryLog(server, "Flushed memory log")
+					} else if strings.EqualFold(cmd.name, recoverSpoolsCmd) {
+						err = recoverOtherLogSpools(server)
+					}
+					if cmd.done != nil {
+						cmd.done <- err
 					}
 					continue
 				}
@@ -60,78 +78,242 @@ func entryBoundMemoryLogger(server *NicoServer) {
 				}
 		}
 	}
+	if undeliveredLogs(server) {
+		n, err := dumpMemoryLog(server)
+		fmt.Printf("Final memory log flush for service %s: snapshotID=%d, entries=%d, bytesWritten=%d, error=%s\n",
+			server.svcName, server.snapshotID, server.nextLogID, n, err)
+	}
 	fmt.Printf("Closing memory log channel for service %s ..... \n", server.svcName)
 }
 
 
 func appendLogEntry(server *NicoServer, le *memoryLogEntry) {
 	if server.nextLogID == cap(server.memLog) {
-		server.snapshotID++
-		n, err := dumpMemoryLog(server)
-		server.evictedLogSize += server.memLogSize
-		s := fmt.Sprintf("Dumped memory log snapshot to disk: snapshotID=%d, entries=%d, bytesWritten=%d, error=%s", 
-													server.snapshotID, server.nextLogID, n, err)
-		server.nextLogID = 0
-		e := memoryLogEntry{ID: server.nextLogID, TS: time.Now().UnixNano(), LE: s}
-		server.memLog = make([]memoryLogEntry, server.memLogSize, server.memLogSize)
-		server.memLog[server.nextLogID] = e
-		server.nextLogID++
+		rotateMemoryLog(server, "Dumped memory log snapshot to disk")
+	} else if server.logBytesQoS > 0 && server.pendingLogEntries > 0 && server.memLogBytes + len(le.LE) > server.logBytesQoS {
+		rotateMemoryLog(server, "Dumped memory log snapshot to disk (bytes QoS)")
+	}
+	storeLogEntry(server, le)
+	server.pendingLogEntries++
+}
+
+// rotateMemoryLog - persists the memory log to the sink and starts a fresh one whose first entry
+// records the outcome of the dump
+func rotateMemoryLog(server *NicoServer, reason string) error {
+	n, err := dumpMemoryLog(server)
+	s := fmt.Sprintf("%s: snapshotID=%d, entries=%d, bytesWritten=%d, error=%s",
+		reason, server.snapshotID, server.nextLogID, n, err)
+	e := memoryLogEntry{ID: 0, TS: time.Now().UnixNano(), LE: s}
+	server.memLogLock.Lock()
+	server.evictedLogSize += server.nextLogID
+	server.nextLogID = 0
+	server.memLog = make([]memoryLogEntry, server.memLogSize, server.memLogSize)
+	server.memLogLock.Unlock()
+	server.memLogBytes = 0
+	server.pendingLogEntries = 0
+	storeLogEntry(server, &e)
+	scheduleNextFlush(server)
+	return err
+}
+
+// scheduleNextFlush - restarts the flush interval, whichever QoS was met last
+func scheduleNextFlush(server *NicoServer) {
+	if server.logFlushInterval > 0 {
+		atomic.StoreInt64(&server.nextFlushTime, time.Now().Add(server.logFlushInterval).UnixNano())
 	}
+}
+
+// storeLogEntry - places the entry in the next memory log slot, spooling it first when the
+// write-ahead spool is enabled
+func storeLogEntry(server *NicoServer, le *memoryLogEntry) {
 	le.ID = server.nextLogID
+	if server.spool != nil {
+		if err := server.spool.append(le); err != nil {
+			recordSpoolError(server, err)
+		}
+	}
+	server.memLogLock.Lock()
 	server.memLog[server.nextLogID] = *le
 	server.nextLogID++
+	server.memLogLock.Unlock()
+	server.memLogBytes += len(le.LE)
 }
 
+// logHead - a copy of the first size entries, the memory logger keeps writing to the memory log
 func logHead(size int, server *NicoServer) []memoryLogEntry {
+	server.memLogLock.RLock()
+	defer server.memLogLock.RUnlock()
 	if size > server.nextLogID {
-		return server.memLog[0:server.nextLogID]
+		size = server.nextLogID
 	}
-	return server.memLog[0:size]
+	return append([]memoryLogEntry{}, server.memLog[0:size]...)
 }
 
+// logTail - a copy of the last size entries
 func logTail(size int, server *NicoServer) []memoryLogEntry {
-	if size >= server.nextLogID {
-		return logHead(size, server)
+	server.memLogLock.RLock()
+	defer server.memLogLock.RUnlock()
+	if size > server.nextLogID {
+		size = server.nextLogID
 	}
-	return server.memLog[server.nextLogID-size : server.nextLogID]
+	return append([]memoryLogEntry{}, server.memLog[server.nextLogID-size : server.nextLogID]...)
 }
 
 func logSize(server *NicoServer) (maxsize int, current int, evicted int) {
+	server.memLogLock.RLock()
+	defer server.memLogLock.RUnlock()
 	return len(server.memLog), server.nextLogID, server.evictedLogSize
 }
 
+// logNextFlush - time (unix nano) of the next periodic flush, 0 if there is no flush interval
+func logNextFlush(server *NicoServer) int64 {
+	if server.logFlushInterval <= 0 {
+		return 0
+	}
+	return atomic.LoadInt64(&server.nextFlushTime)
+}
+
 type logWriter struct {
 	existing io.Writer
+	server *NicoServer
 }
 
-func newLogWriter(e io.Writer) io.Writer {
-	l := logWriter{existing: e}
+func newLogWriter(e io.Writer, server *NicoServer) io.Writer {
+	l := logWriter{existing: e, server: server}
 	return &l
 }
 
 func (lw logWriter) Write(p []byte) (n int, err error) {
-	n, e := lw.existing.Write(p)
-	if (builder.server.logChanState == 1) {
-		builder.server.logChan <- string(p)
+	if lw.server.redactor == nil {
+		n, err = lw.existing.Write(p)
+		queueLogEntry(lw.server, string(p))
+		return n, err
+	}
+	msg := redactLogEntry(lw.server, string(p))
+	if _, err = io.WriteString(lw.existing, msg); err != nil {
+		return 0, err
 	}
-	return n, e
+	queueLogEntry(lw.server, msg)
+	return len(p), nil
 }
 
+// emitLogEntry - hands msg, once redacted, to the memory logger unless it has been stopped
+func emitLogEntry(server *NicoServer, msg string) {
+	queueLogEntry(server, redactLogEntry(server, msg))
+}
+
+func queueLogEntry(server *NicoServer, msg string) {
+	server.logChanLock.RLock()
+	defer server.logChanLock.RUnlock()
+	if atomic.LoadUint32(&server.logChanState) == 1 {
+		server.logChan <- msg
+	}
+}
+
+// flushMemoryLog - asks the memory logger to persist its entries to the sink, waiting for the
+// outcome no longer than the context allows
+func flushMemoryLog(ctx context.Context, server *NicoServer) error {
+	if atomic.LoadUint32(&server.logChanState) != 1 {
+		return errors.New("memory logger is not running")
+	}
+	done := make(chan error, 1)
+	select {
+		case server.logCmdChan <- logCommand{name: flushLogCmd, done: done}:
+		case <-ctx.Done():
+			return ctx.Err()
+	}
+	select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+	}
+}
+
+// stopMemoryLogger - closes the log channel so the memory logger performs its final flush, and
+// waits for it no longer than the context allows
+func stopMemoryLogger(ctx context.Context, server *NicoServer) error {
+	server.logChanLock.Lock()
+	if !atomic.CompareAndSwapUint32(&server.logChanState, 1, 0) {
+		server.logChanLock.Unlock()
+		return nil
+	}
+	close(server.logChan)
+	server.logChanLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		server.logChanReceivers.Wait()
+		close(done)
+	}()
+	select {
+		case <-done:
+			if server.spool != nil {
+				server.spool.close()
+			}
+			return nil
+		case <-ctx.Done():
+			fmt.Printf("Final memory log flush for service %s abandoned: %s\n", server.svcName, ctx.Err())
+			return ctx.Err()
+	}
+}
+
+// dumpMemoryLog - persists the memory log to the sink, together with the entries of earlier
+// dumps that failed: replayed from the spool when there is one, kept in memory otherwise. The
+// spool is only reset once all the entries it holds reached the sink
 func dumpMemoryLog(server *NicoServer) (bytesWritten int, err error) {
 	fmt.Println("Dumping memory log ......")
 	server.snapshotID++
+	if server.spool != nil && server.spoolBacklog {
+		return dumpLogSpool(server)
+	}
+	entries := server.memLog[0:server.nextLogID]
+	spooled := server.spool != nil
+	if len(server.undelivered) > 0 {
+		entries = append(server.undelivered, entries...)
+	}
+	n, err := dumpLogEntries(server, entries)
+	recordDump(server, err)
+	if err != nil {
+		if server.spool != nil {
+			server.spoolBacklog = true
+		} else {
+			server.undelivered = undeliveredTail(entries, server.memLogSize)
+		}
+		return n, err
+	}
+	server.undelivered = nil
+	if spooled {
+		server.spoolBacklog = false
+		server.spool.reset()
+	}
+	return n, err
+}
+
+
+// undeliveredTail - a copy of the last max entries, those kept for the next dump when the sink
+// failed and there is no spool to replay them from
+func undeliveredTail(entries []memoryLogEntry, max int) []memoryLogEntry {
+	if max > 0 && len(entries) > max {
+		entries = entries[len(entries)-max:]
+	}
+	return append([]memoryLogEntry(nil), entries...)
+}
+
+
+// undeliveredLogs - whether entries are waiting for the sink, new ones or those of a failed dump
+func undeliveredLogs(server *NicoServer) bool {
+	return server.pendingLogEntries > 0 || server.spoolBacklog || len(server.undelivered) > 0
+}
+
+
+func dumpLogEntries(server *NicoServer, entries []memoryLogEntry) (bytesWritten int, err error) {
 	switch (server.sink) {
 		case FILE:
-			var dir string
-			if flagset["logFileDir"] {
-				dir = *argLogFileDir
-			} else {
-				dir = "."
-			}
-			f := fmt.Sprintf("%s/%s.log.%d", dir, server.svcName, server.snapshotID)
-			return dumpMemoryLogToFile(f, server)
+			f := fmt.Sprintf("%s/%s.log.%d", logFileDir(server), server.svcName, server.snapshotID)
+			return dumpMemoryLogToFile(f, entries)
 		case STDOUT:
-			return dumpMemoryLogToStdout(server)
+			return dumpMemoryLogToStdout(entries)
 		default:
 			fmt.Println("Unsupported log sink ......")
 			return 0, errors.New("Unsupported log sink")
@@ -139,14 +321,23 @@ func dumpMemoryLog(server *NicoServer) (bytesWritten int, err error) {
 }
 
 
-func dumpMemoryLogToFile(file string, server *NicoServer) (bytesWritten int, err error) {
+// logFileDir - directory the memory log of server is persisted to
+func logFileDir(server *NicoServer) string {
+	if server == nil || server.logDir == "" {
+		return defaultLogFileDir
+	}
+	return server.logDir
+}
+
+
+func dumpMemoryLogToFile(file string, entries []memoryLogEntry) (bytesWritten int, err error) {
 	fmt.Println("Dumping memory log ...... to FILE Sink")
 	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		return 0, err
 	}
 	defer f.Close()
-	js, err := json.MarshalIndent(server.memLog[0:server.nextLogID], "", "\t")
+	js, err := json.MarshalIndent(entries, "", "\t")
 
 	if err != nil {
 		return 0, err
@@ -156,10 +347,10 @@ func dumpMemoryLogToFile(file string, server *NicoServer) (bytesWritten int, err
 }
 
 
-func dumpMemoryLogToStdout(server *NicoServer) (bytesWritten int, err error) {
+func dumpMemoryLogToStdout(entries []memoryLogEntry) (bytesWritten int, err error) {
 	fmt.Println("Dumping memory log ...... to STDOUT Sink")
 
-	js, err := json.MarshalIndent(server.memLog[0:server.nextLogID], "", "\t")
+	js, err := json.MarshalIndent(entries, "", "\t")
 
 	if err != nil {
 		return 0, err
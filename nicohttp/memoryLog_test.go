@@ -0,0 +1,215 @@
+package nicohttp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+
+// runWithFileSink - runs a service whose memory log goes to the FILE sink in dir
+func runWithFileSink(t *testing.T, b *NicoBuilder, dir string) (*NicoServer, uint32, chan error) {
+	p := getLoggerPort()
+	srv, err := b.WithoutStdLog().WithLogSink(FILE).Create(t.Name(), p)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	srv.logDir = dir
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(context.Background())
+	}()
+	<-srv.Ready()
+	return srv, p, done
+}
+
+
+func TestFinalFlush(t *testing.T) {
+	triggers := map[string]func(srv *NicoServer, p uint32){
+		"Stop": func(srv *NicoServer, p uint32) {
+			srv.Stop()
+		},
+		"SIGTERM": func(srv *NicoServer, p uint32) {
+			srv.interruptChannel <- syscall.SIGTERM
+		},
+		"shutdown": func(srv *NicoServer, p uint32) {
+			resp, err := http.Post(getTarget(p, uriShutdown), "", nil)
+			if err == nil {
+				resp.Body.Close()
+			}
+		},
+	}
+	for name, trigger := range triggers {
+		dir := t.TempDir()
+		srv, p, done := runWithFileSink(t, GetBuilder().WithDefaults(), dir)
+		srv.Logger().Printf("logged before %s", name)
+		trigger(srv, p)
+		select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("%s: %s did not stop the service", t.Name(), name)
+		}
+		sink := sinkContents(t, dir, t.Name())
+		if !strings.Contains(sink, "logged before " + name) {
+			t.Fatalf("%s: entries not flushed on %s: %s", t.Name(), name, sink)
+		}
+		/* the final flush is the first snapshot */
+		if _, err := os.Stat(filepath.Join(dir, t.Name() + ".log.1")); err != nil {
+			t.Fatalf("%s: %s", t.Name(), err)
+		}
+	}
+}
+
+
+func TestSnapshotIDs(t *testing.T) {
+	dir := t.TempDir()
+	srv, _, done := runWithFileSink(t, GetBuilder().WithDefaults(), dir)
+	for i := 1; i <= 3; i++ {
+		srv.Logger().Printf("entry %d", i)
+		if err := flushMemoryLog(context.Background(), srv); err != nil {
+			t.Fatalf("%s: %s", t.Name(), err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, t.Name() + ".log." + string(rune('0' + i)))); err != nil {
+			t.Fatalf("%s: snapshot %d: %s", t.Name(), i, err)
+		}
+	}
+	srv.Stop()
+	<-done
+}
+
+
+func TestDumpLog(t *testing.T) {
+	dir := t.TempDir()
+	srv, p, done := runWithFileSink(t, GetBuilder().WithDefaults(), dir)
+	dump := func() int {
+		resp, err := http.Post(getTarget(p, uriDumpLog), "", nil)
+		if err != nil {
+			t.Fatalf("%s: %s", t.Name(), err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	srv.Logger().Printf("dumped on request")
+	if status := dump(); status != http.StatusNoContent {
+		t.Fatalf("%s: expected %d, actual = %d", t.Name(), http.StatusNoContent, status)
+	}
+	if sink := sinkContents(t, dir, t.Name()); !strings.Contains(sink, "dumped on request") {
+		t.Fatalf("%s: entry not dumped: %s", t.Name(), sink)
+	}
+	/* a failed dump is reported, not only logged */
+	srv.logDir = filepath.Join(dir, "missing")
+	if status := dump(); status != http.StatusInternalServerError {
+		t.Fatalf("%s: expected %d, actual = %d", t.Name(), http.StatusInternalServerError, status)
+	}
+	srv.logDir = dir
+	srv.Stop()
+	<-done
+
+	/* once the memory logger is gone the request must not block */
+	answered := make(chan int, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, uriDumpLog, nil))
+		answered <- rec.Code
+	}()
+	select {
+		case status := <-answered:
+			if status != http.StatusServiceUnavailable {
+				t.Fatalf("%s: expected %d, actual = %d", t.Name(), http.StatusServiceUnavailable, status)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: dumplog blocked after the memory logger stopped", t.Name())
+	}
+}
+
+
+func TestPanicFlush(t *testing.T) {
+	for _, recovery := range []bool{true, false} {
+		dir := t.TempDir()
+		b := GetBuilder().WithDefaults()
+		if !recovery {
+			b = b.WithoutMiddleware(RecoveryStage)
+		}
+		srv, p, done := runWithFileSink(t, b, dir)
+		srv.Mux().HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+			srv.Logger().Printf("logged before the panic")
+			panic("handler bug")
+		})
+		if resp, err := http.Get(getTarget(p, "/panic")); err == nil {
+			resp.Body.Close()
+		}
+		/* flushed while the service keeps running */
+		sink := sinkContents(t, dir, t.Name())
+		if !strings.Contains(sink, "logged before the panic") || !strings.Contains(sink, "handler bug") {
+			t.Fatalf("%s: recovery %t: entries not flushed on panic: %s", t.Name(), recovery, sink)
+		}
+		srv.Stop()
+		<-done
+	}
+}
+
+
+// waitForSink - waits for the FILE sink in dir to hold s
+func waitForSink(t *testing.T, dir, s string, within time.Duration) string {
+	deadline := time.Now().Add(within)
+	for {
+		sink := sinkContents(t, dir, t.Name())
+		if strings.Contains(sink, s) || time.Now().After(deadline) {
+			return sink
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+
+func TestFlushInterval(t *testing.T) {
+	dir := t.TempDir()
+	b := GetBuilder().WithDefaults().WithMemoryLogger(EntryBound, 1000, FlushInterval(300 * time.Millisecond))
+	srv, p, done := runWithFileSink(t, b, dir)
+	if srv.logFlushInterval != 300 * time.Millisecond {
+		t.Fatalf("%s: flush interval %s", t.Name(), srv.logFlushInterval)
+	}
+
+	resp, err := http.Get(getTarget(p, uriLogSize))
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	var size map[string]int64
+	json.NewDecoder(resp.Body).Decode(&size)
+	resp.Body.Close()
+	next := time.Unix(0, size["nextFlush"])
+	if until := time.Until(next); until <= 0 || until > 300 * time.Millisecond {
+		t.Fatalf("%s: nextFlush %s, expected within the flush interval", t.Name(), next)
+	}
+
+	srv.Logger().Printf("flushed by the interval")
+	if sink := waitForSink(t, dir, "flushed by the interval", 2 * time.Second); !strings.Contains(sink, "flushed by the interval") {
+		t.Fatalf("%s: entry not flushed periodically: %s", t.Name(), sink)
+	}
+	srv.Stop()
+	<-done
+}
+
+
+func TestFlushBytes(t *testing.T) {
+	dir := t.TempDir()
+	b := GetBuilder().WithDefaults().WithMemoryLogger(EntryBound, 1000, FlushBytes(150))
+	srv, _, done := runWithFileSink(t, b, dir)
+	filler := strings.Repeat("x", 60)
+	srv.Logger().Printf("first %s", filler)
+	srv.Logger().Printf("second %s", filler)
+	/* the second entry would exceed the bytes QoS, the first is flushed without it */
+	sink := waitForSink(t, dir, "first " + filler, 2 * time.Second)
+	if !strings.Contains(sink, "first " + filler) || strings.Contains(sink, "second " + filler) {
+		t.Fatalf("%s: expected only the first entry flushed by the bytes QoS: %s", t.Name(), sink)
+	}
+	srv.Stop()
+	<-done
+}
@@ -0,0 +1,43 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package nicohttp
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+
+func TestFinalFlushBoundedByShutdownTimeout(t *testing.T) {
+	dir := t.TempDir()
+	/* a sink nobody reads blocks the final flush once the pipe is full */
+	fifo := filepath.Join(dir, t.Name() + ".log.1")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Skipf("%s: %s", t.Name(), err)
+	}
+	srv, _, done := runWithFileSink(t, GetBuilder().WithDefaults().WithShutdownTimeout(time.Second), dir)
+	line := strings.Repeat("x", 16 * 1024)
+	for i := 0; i < 8; i++ {
+		srv.Logger().Printf("%s", line)
+	}
+
+	start := time.Now()
+	if err := srv.Stop(); err == nil {
+		t.Fatalf("%s: expected an incomplete shutdown", t.Name())
+	}
+	<-done
+	if elapsed := time.Since(start); elapsed > 5 * time.Second {
+		t.Fatalf("%s: final flush not bounded by the shutdown timeout, took %s", t.Name(), elapsed)
+	}
+	/* unblock the abandoned flush */
+	f, err := os.OpenFile(fifo, os.O_RDONLY, 0)
+	if err == nil {
+		io.Copy(io.Discard, f)
+		f.Close()
+	}
+}
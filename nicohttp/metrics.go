@@ -0,0 +1,476 @@
+package nicohttp
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	metricsContentType string = "text/plain; version=0.0.4; charset=utf-8"
+	metricsNamespace string = "nicohttp"
+)
+
+var (
+	// DefaultLatencyBuckets - upper bounds (seconds) of the request latency histogram
+	DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	/* the only escapes of label values in the text format */
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// MetricsRegistry - metrics exposed by /metrics in Prometheus text format
+type MetricsRegistry struct {
+	mu sync.Mutex
+	metrics map[string]metric
+	collectors []func(w io.Writer)
+}
+
+type metricDesc struct {
+	fqName string
+	help string
+	labels []string
+}
+
+// Counter - monotonically increasing value, optionally partitioned by labels
+type Counter struct {
+	metricDesc
+	mu sync.Mutex
+	values map[string]float64
+}
+
+// Gauge - value that can go up and down, optionally partitioned by labels
+type Gauge struct {
+	metricDesc
+	mu sync.Mutex
+	values map[string]float64
+}
+
+// Histogram - distribution of observed values, optionally partitioned by labels
+type Histogram struct {
+	metricDesc
+	buckets []float64
+	mu sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	count uint64
+	sum float64
+}
+
+
+func newMetricsRegistry() (*MetricsRegistry) {
+	return &MetricsRegistry{metrics: make(map[string]metric)}
+}
+
+
+func (reg *MetricsRegistry) register(m metric) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.metrics[m.name()]; ok {
+		panic(fmt.Sprintf("metric %s already registered", m.name()))
+	}
+	reg.metrics[m.name()] = m
+}
+
+
+// NewCounter - registers a counter with the given label names
+func (reg *MetricsRegistry) NewCounter(name, help string, labels ...string) (*Counter) {
+	c := &Counter{metricDesc: metricDesc{fqName: name, help: help, labels: labels}, values: make(map[string]float64)}
+	if len(labels) == 0 {
+		c.values[""] = 0
+	}
+	reg.register(c)
+	return c
+}
+
+
+// NewGauge - registers a gauge with the given label names
+func (reg *MetricsRegistry) NewGauge(name, help string, labels ...string) (*Gauge) {
+	g := &Gauge{metricDesc: metricDesc{fqName: name, help: help, labels: labels}, values: make(map[string]float64)}
+	if len(labels) == 0 {
+		g.values[""] = 0
+	}
+	reg.register(g)
+	return g
+}
+
+
+// NewHistogram - registers a histogram with the given bucket upper bounds and label names
+func (reg *MetricsRegistry) NewHistogram(name, help string, buckets []float64, labels ...string) (*Histogram) {
+	b := append([]float64{}, buckets...)
+	sort.Float64s(b)
+	h := &Histogram{metricDesc: metricDesc{fqName: name, help: help, labels: labels}, buckets: b, values: make(map[string]*histogramValue)}
+	reg.register(h)
+	return h
+}
+
+
+// NewGaugeFunc - registers a gauge whose value is read from f at scrape time
+func (reg *MetricsRegistry) NewGaugeFunc(name, help string, f func() float64) {
+	reg.collect(func(w io.Writer) {
+		writeHeader(w, name, help, "gauge")
+		writeSample(w, name, "", f())
+	})
+}
+
+
+func (reg *MetricsRegistry) collect(f func(w io.Writer)) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.collectors = append(reg.collectors, f)
+}
+
+
+// Expose - writes all metrics in Prometheus text format
+func (reg *MetricsRegistry) Expose(w io.Writer) {
+	reg.mu.Lock()
+	names := make([]string, 0, len(reg.metrics))
+	for n := range reg.metrics {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, 0, len(names))
+	for _, n := range names {
+		metrics = append(metrics, reg.metrics[n])
+	}
+	collectors := append([]func(io.Writer){}, reg.collectors...)
+	reg.mu.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+	for _, c := range collectors {
+		c(w)
+	}
+}
+
+
+func (d *metricDesc) name() string {
+	return d.fqName
+}
+
+
+func (d *metricDesc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", d.fqName, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+
+func (d *metricDesc) labelString(key string, extra ...string) string {
+	pairs := make([]string, 0, len(d.labels)+1)
+	if len(d.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i] + "=\"" + labelEscaper.Replace(v) + "\"")
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i] + "=\"" + labelEscaper.Replace(extra[i+1]) + "\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+
+// Inc - adds 1 to the counter for the label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+
+// Add - adds v (>= 0) to the counter for the label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter %s cannot decrease", c.fqName))
+	}
+	k := c.key(labelValues)
+	c.mu.Lock()
+	c.values[k] += v
+	c.mu.Unlock()
+}
+
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.fqName, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range sortedKeys(c.values) {
+		writeSample(w, c.fqName, c.labelString(k), c.values[k])
+	}
+}
+
+
+// Set - sets the gauge for the label values
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	k := g.key(labelValues)
+	g.mu.Lock()
+	g.values[k] = v
+	g.mu.Unlock()
+}
+
+
+// Add - adds v (which may be negative) to the gauge for the label values
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	k := g.key(labelValues)
+	g.mu.Lock()
+	g.values[k] += v
+	g.mu.Unlock()
+}
+
+
+// Inc - adds 1 to the gauge for the label values
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+
+// Dec - subtracts 1 from the gauge for the label values
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+
+func (g *Gauge) write(w io.Writer) {
+	writeHeader(w, g.fqName, g.help, "gauge")
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, k := range sortedKeys(g.values) {
+		writeSample(w, g.fqName, g.labelString(k), g.values[k])
+	}
+}
+
+
+// Observe - records v for the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	k := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.values[k]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hv
+	}
+	for i, ub := range h.buckets {
+		if v <= ub {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+
+func (h *Histogram) write(w io.Writer) {
+	writeHeader(w, h.fqName, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hv := h.values[k]
+		for i, ub := range h.buckets {
+			writeSample(w, h.fqName+"_bucket", h.labelString(k, "le", formatFloat(ub)), float64(hv.counts[i]))
+		}
+		writeSample(w, h.fqName+"_bucket", h.labelString(k, "le", "+Inf"), float64(hv.count))
+		writeSample(w, h.fqName+"_sum", h.labelString(k), hv.sum)
+		writeSample(w, h.fqName+"_count", h.labelString(k), float64(hv.count))
+	}
+}
+
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.ReplaceAll(help, "\n", " "), name, kind)
+}
+
+
+func writeSample(w io.Writer, name, labels string, v float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(v))
+}
+
+
+func formatFloat(v float64) string {
+	switch {
+		case math.IsInf(v, 1):
+			return "+Inf"
+		case math.IsInf(v, -1):
+			return "-Inf"
+		default:
+			return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+
+// methodLabel - the request method, other for tokens outside the standard methods so that clients
+// cannot grow the label set
+func methodLabel(method string) string {
+	switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+			http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+			return method
+	}
+	return "other"
+}
+
+
+/**************** Built-in server metrics **********************/
+
+type serverMetrics struct {
+	requests *Counter
+	latency *Histogram
+	inFlight int64
+	dumps *Counter
+	dumpErrors *Counter
+	panics *Counter
+	timeouts *Counter
+	spoolWriteErrors *Counter
+	spoolDropped *Counter
+}
+
+
+func initServerMetrics(server *NicoServer) {
+	reg := newMetricsRegistry()
+	server.metrics = reg
+	server.serverMetrics = &serverMetrics{
+		requests: reg.NewCounter(metricsNamespace+"_http_requests_total", "HTTP requests served", "route", "method", "status"),
+		latency: reg.NewHistogram(metricsNamespace+"_http_request_duration_seconds", "HTTP request latency", DefaultLatencyBuckets, "route", "method", "status"),
+		dumps: reg.NewCounter(metricsNamespace+"_memory_log_dumps_total", "Memory log dumps to the log sink"),
+		dumpErrors: reg.NewCounter(metricsNamespace+"_memory_log_dump_errors_total", "Memory log dumps to the log sink that failed"),
+		panics: reg.NewCounter(metricsNamespace+"_http_panics_total", "Handler panics recovered", "route", "method"),
+		timeouts: reg.NewCounter(metricsNamespace+"_http_timeouts_total", "Handlers that timed out", "route", "method"),
+		spoolWriteErrors: reg.NewCounter(metricsNamespace+"_memory_log_spool_write_errors_total", "Memory log entries the spool failed to write"),
+		spoolDropped: reg.NewCounter(metricsNamespace+"_memory_log_spool_dropped_total", "Memory log entries not spooled as the spool was full"),
+	}
+	sm := server.serverMetrics
+	reg.NewGaugeFunc(metricsNamespace+"_http_requests_in_flight", "HTTP requests currently being served", func() float64 {
+		return float64(atomic.LoadInt64(&sm.inFlight))
+	})
+	reg.NewGaugeFunc(metricsNamespace+"_suspended", "1 if the service is suspended", func() float64 {
+		return float64(atomic.LoadInt32(&server.suspended))
+	})
+	reg.NewGaugeFunc(metricsNamespace+"_uptime_seconds", "Time since the service started", func() float64 {
+		started := server.started()
+		if started.IsZero() {
+			return 0
+		}
+		return time.Since(started).Seconds()
+	})
+	reg.NewGaugeFunc(metricsNamespace+"_memory_log_capacity_entries", "Memory log capacity", func() float64 {
+		max, _, _ := logSize(server)
+		return float64(max)
+	})
+	reg.NewGaugeFunc(metricsNamespace+"_memory_log_entries", "Entries currently held in the memory log", func() float64 {
+		_, current, _ := logSize(server)
+		return float64(current)
+	})
+	reg.NewGaugeFunc(metricsNamespace+"_memory_log_evicted_entries", "Entries evicted from the memory log to the sink", func() float64 {
+		_, _, evicted := logSize(server)
+		return float64(evicted)
+	})
+	reg.collect(writeRuntimeMetrics)
+}
+
+
+func writeRuntimeMetrics(w io.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	gauges := []struct {
+		name string
+		help string
+		v float64
+	}{
+		{"go_goroutines", "Number of goroutines", float64(runtime.NumGoroutine())},
+		{"go_gomaxprocs", "GOMAXPROCS setting", float64(runtime.GOMAXPROCS(0))},
+		{"go_memstats_alloc_bytes", "Bytes allocated and still in use", float64(ms.Alloc)},
+		{"go_memstats_heap_inuse_bytes", "Heap bytes in use", float64(ms.HeapInuse)},
+		{"go_memstats_heap_objects", "Number of allocated heap objects", float64(ms.HeapObjects)},
+		{"go_memstats_sys_bytes", "Bytes obtained from the OS", float64(ms.Sys)},
+		{"go_memstats_last_gc_time_seconds", "Time of the last garbage collection", float64(ms.LastGC) / 1e9},
+	}
+	for _, g := range gauges {
+		writeHeader(w, g.name, g.help, "gauge")
+		writeSample(w, g.name, "", g.v)
+	}
+	writeHeader(w, "go_gc_cycles_total", "Completed GC cycles", "counter")
+	writeSample(w, "go_gc_cycles_total", "", float64(ms.NumGC))
+	writeHeader(w, "go_gc_pause_seconds_total", "Total GC pause time", "counter")
+	writeSample(w, "go_gc_pause_seconds_total", "", float64(ms.PauseTotalNs) / 1e9)
+}
+
+
+func (h *NicoServer) metricsMediator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sm := h.serverMetrics
+		atomic.AddInt64(&sm.inFlight, 1)
+		defer atomic.AddInt64(&sm.inFlight, -1)
+
+		start := time.Now()
+		sw := statusResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(&sw, r)
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := routeName(h.httpRouter, r)
+		if route == "" {
+			route = "unmatched"
+		}
+		sc := statusClass(status)
+		method := methodLabel(r.Method)
+		sm.requests.Inc(route, method, sc)
+		sm.latency.Observe(time.Since(start).Seconds(), route, method, sc)
+	})
+}
+
+
+func recordDump(server *NicoServer, err error) {
+	server.serverMetrics.dumps.Inc()
+	if err != nil {
+		server.serverMetrics.dumpErrors.Inc()
+	}
+}
+
+
+func (h *NicoServer) getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	h.metrics.Expose(w)
+}
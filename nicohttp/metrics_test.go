@@ -0,0 +1,138 @@
+package nicohttp
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+
+func TestMetricsExposition(t *testing.T) {
+	reg := newMetricsRegistry()
+	c := reg.NewCounter("orders_total", "Orders placed", "region")
+	g := reg.NewGauge("queue_depth", "Queued orders")
+	h := reg.NewHistogram("order_seconds", "Order latency", []float64{1, 0.1})
+	c.Inc("us")
+	c.Add(2, "eu")
+	g.Set(5)
+	g.Dec()
+	h.Observe(0.05)
+	h.Observe(0.5)
+
+	var buf bytes.Buffer
+	reg.Expose(&buf)
+	actual := buf.String()
+	expected := []string{
+		"# TYPE orders_total counter\n",
+		"orders_total{region=\"eu\"} 2\n",
+		"orders_total{region=\"us\"} 1\n",
+		"# TYPE queue_depth gauge\n",
+		"queue_depth 4\n",
+		"order_seconds_bucket{le=\"0.1\"} 1\n",
+		"order_seconds_bucket{le=\"1\"} 2\n",
+		"order_seconds_bucket{le=\"+Inf\"} 2\n",
+		"order_seconds_sum 0.55\n",
+		"order_seconds_count 2\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(actual, e) {
+			t.Fatalf("%s: %q not found in\n%s", t.Name(), e, actual)
+		}
+	}
+}
+
+
+func TestMetricsLabelMismatch(t *testing.T) {
+	reg := newMetricsRegistry()
+	c := reg.NewCounter("requests_total", "Requests", "route", "method")
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("%s: expected panic on label value mismatch", t.Name())
+		}
+	}()
+	c.Inc("only-route")
+}
+
+
+func TestStatusClass(t *testing.T) {
+	for status, expected := range map[int]string{200: "2xx", 204: "2xx", 404: "4xx", 503: "5xx", 0: "unknown"} {
+		if actual := statusClass(status); actual != expected {
+			t.Fatalf("%s: status = %d, expected = %s, actual = %s", t.Name(), status, expected, actual)
+		}
+	}
+}
+
+
+func TestMethodLabel(t *testing.T) {
+	for method, expected := range map[string]string{"GET": "GET", "DELETE": "DELETE", "get": "other",
+		"PROPFIND": "other", "X-1234": "other"} {
+		if actual := methodLabel(method); actual != expected {
+			t.Fatalf("%s: method = %s, expected = %s, actual = %s", t.Name(), method, expected, actual)
+		}
+	}
+}
+
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	reg := newMetricsRegistry()
+	c := reg.NewCounter("paths_total", "Paths", "path")
+	c.Inc("/a\\b\"c\"\nd\té")
+	var buf bytes.Buffer
+	reg.Expose(&buf)
+	expected := "paths_total{path=\"/a\\\\b\\\"c\\\"\\nd\té\"} 1\n"
+	if !strings.Contains(buf.String(), expected) {
+		t.Fatalf("%s: %q not found in\n%s", t.Name(), expected, buf.String())
+	}
+}
+
+
+func TestStatusResponseWriterFlush(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sw := &statusResponseWriter{ResponseWriter: rec}
+	var w http.ResponseWriter = sw
+	f, ok := w.(http.Flusher)
+	if !ok {
+		t.Fatalf("%s: not a http.Flusher", t.Name())
+	}
+	f.Flush()
+	if !rec.Flushed || sw.status != http.StatusOK {
+		t.Fatalf("%s: flushed %t, status %d", t.Name(), rec.Flushed, sw.status)
+	}
+	if sw.Unwrap() != rec {
+		t.Fatalf("%s: Unwrap does not return the wrapped writer", t.Name())
+	}
+}
+
+
+func TestMemoryLogMetricsWhileLogging(t *testing.T) {
+	b := GetBuilder().WithDefaults().WithoutStdLog().WithLogSink(STDOUT).WithMemoryLogger(EntryBound, 10)
+	srv, err := b.Create(t.Name(), 0)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	go srv.Run(context.Background())
+	<-srv.Ready()
+	defer srv.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			srv.logger.Printf("entry %d", i)
+		}
+	}()
+	for {
+		select {
+			case <-done:
+				return
+			default:
+				var buf bytes.Buffer
+				srv.metrics.Expose(&buf)
+				logHead(5, srv)
+				logTail(5, srv)
+		}
+	}
+}
@@ -1,12 +1,15 @@
 package nicohttp
 
 import (
+	"io"
 	"net/http"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"fmt"
 	"context"
@@ -17,10 +20,14 @@ import (
 const (
 	defaultHandlerTimeout time.Duration = 300 * time.Second
 	defaultRateLimit int = 500
-	defaultShutdownWait time.Duration = 120 * time.Second
+	defaultShutdownWait time.Duration = 60 * time.Second
 	defaultLogFileDir string = "."
 )
 
+var (
+	defaultShutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+)
+
 //NicoServer - constructed HTTP Server with required optionality
 type NicoServer struct {
 	svcName string
@@ -29,13 +36,24 @@ type NicoServer struct {
 	builder *NicoBuilder
 	handlerTimeout time.Duration
 	shutdownWait time.Duration
+	preStopDelay time.Duration
 	logQoS int
+	logBytesQoS int
+	logFlushInterval time.Duration
 	maxLogEntries int
 
 	healthy    		int32
+	draining    	int32
 	suspended    	int32
 	httpRouter 		*mux.Router
 	interruptChannel chan os.Signal
+	signals []os.Signal
+	serveErr chan error
+	ready chan struct{}
+	startErr error
+	stopping chan struct{}
+	stopOnce sync.Once
+	stopComplete bool
 	startTime time.Time
 	suspendTime time.Time
 	suspendDuration time.Duration
@@ -44,13 +62,50 @@ type NicoServer struct {
 	nextLogID      int
 	evictedLogSize int
 	memLogSize     int
+	memLogBytes    int
+	pendingLogEntries int
+	nextFlushTime  int64
 	memLog         []memoryLogEntry
+	memLogLock     sync.RWMutex
 	logChan        chan string
 	logChanState	uint32
-	logCmdChan		chan string
+	logChanLock		sync.RWMutex
+	logCmdChan		chan logCommand
 	snapshotID     int
+	spoolDir       string
+	spool          *logSpool
+	spoolBacklog   bool
+	spoolMax       int64
+	undelivered    []memoryLogEntry
+	redactor       *Redactor
+	accessLog      accessLogConfig
+	metrics        *MetricsRegistry
+	serverMetrics  *serverMetrics
+	tracer         *tracer
+	breakers       map[string]*CircuitBreaker
+	breakersLock   sync.Mutex
+	groups         []*RouteGroup
+	panicReporter  PanicReporter
+	routeTimeouts  map[*mux.Route]time.Duration
+	timeoutsLock   sync.RWMutex
+	timeoutStatus  int
+	timeoutDetail  string
+	maxBodyBytes   int64
+	listener       net.Listener
+	unixSocket     string
+	socketActivation bool
+	inherited      bool
+	upgradeTimeout time.Duration
+	upgradeSignal  chan os.Signal
+	upgraded       chan struct{}
+	readinessChecks []*healthCheck
+	hooks          map[hookPhase][]lifecycleHook
+	livenessChecks []*healthCheck
 
 	sink logSink
+	logDir string
+	logger *log.Logger
+	logWriter io.Writer
 }
 
 // Builder - access the builder used
@@ -58,64 +113,152 @@ func (h *NicoServer) Builder() (*NicoBuilder) {
 	return h.builder
 }
 
-// Start - the TN Http server
+// Start - the TN Http server, blocking until shutdown. Exits with status 1 if startup is aborted,
+// e.g. the port is in use, or the graceful shutdown did not complete
 func (h *NicoServer) Start() {
+	if err := h.Run(context.Background()); err != nil {
+		fmt.Printf("Service %s: %s\n", h.svcName, err)
+		os.Exit(1)
+	}
+}
+
+
+// Run - starts the service and blocks until ctx is done, a shutdown signal is received (SIGINT
+// or SIGTERM unless WithShutdownSignals), /shutdown is called, Stop is called or the service was
+// upgraded, then drains.
+// Startup failures, bind errors included, are returned immediately
+func (h *NicoServer) Run(ctx context.Context) error {
+	if err := h.startup(); err != nil {
+		h.gracefulStop()
+		err = fmt.Errorf("startup aborted: %w", err)
+		h.builder.mu.Lock()
+		h.startErr = err
+		h.builder.mu.Unlock()
+		close(h.ready)
+		return err
+	}
+	fmt.Printf("Service %s started at %s, start time: %s\n", h.svcName, h.Addr(), h.started() )
+	signal.Notify(h.interruptChannel, h.signals...)
+	defer signal.Stop(h.interruptChannel)
+	if h.upgradeTimeout > 0 {
+		signal.Notify(h.upgradeSignal, syscall.SIGHUP)
+		defer signal.Stop(h.upgradeSignal)
+	}
+
+	var serveErr error
+	for running := true; running; {
+		running = false
+		select {
+			case <-ctx.Done():
+				h.logger.Printf("Service %s shutting down: %s\n", h.svcName, ctx.Err())
+			case sig := <-h.interruptChannel:
+				h.logger.Printf("Service %s shutting down: %s\n", h.svcName, sig)
+			case serveErr = <-h.serveErr:
+				h.logger.Printf("Service %s shutting down: %s\n", h.svcName, serveErr)
+			case <-h.upgradeSignal:
+				h.logger.Printf("Signal driven upgrade triggered for service: %s\n", h.svcName)
+				if err := h.handOff(); err != nil {
+					h.logger.Printf("level=error Service %s upgrade failed, still serving: %s\n", h.svcName, err)
+					running = true
+				}
+			case <-h.upgraded:
+				h.logger.Printf("Service %s shutting down: upgraded\n", h.svcName)
+			case <-h.stopping:
+		}
+	}
+	if !h.gracefulStop() && serveErr == nil {
+		return fmt.Errorf("service %s did not shut down cleanly", h.svcName)
+	}
+	return serveErr
+}
+
+
+// Ready - closed once the service is listening and its OnReady hooks have run, or once its
+// startup failed, see Err
+func (h *NicoServer) Ready() <-chan struct{} {
+	return h.ready
+}
+
+
+// Err - why the startup failed once Ready is closed, nil if the service started
+func (h *NicoServer) Err() error {
+	defer h.builder.mu.Unlock()
+	h.builder.mu.Lock()
+	return h.startErr
+}
+
+
+// Stop - the TN Http server, error if the graceful shutdown did not complete
+func (h *NicoServer) Stop() error {
+	h.logger.Printf("Service %s being stopped.\n", h.svcName)
+	complete := h.gracefulStop()
+	if h.logWriter != nil && log.Writer() == h.logWriter {
+		log.SetOutput(os.Stdout)
+	}
+	if !complete {
+		return fmt.Errorf("service %s did not shut down cleanly", h.svcName)
+	}
+	return nil
+}
+
 
+// startup - starts the memory logger and tracer, runs the OnStart hooks, starts listening, then
+// runs the OnReady hooks
+func (h *NicoServer) startup() error {
+	h.inherited = upgradeInherits(h.svcName)
 	if (!h.builder.disabledMemoryLogs) {
 		h.logChan = make(chan string)
-		h.logCmdChan = make (chan string)
+		h.logCmdChan = make (chan logCommand)
 		h.logChanState = 1
 		h.logChanReceivers.Add(1)
 		h.memLogSize = h.logQoS
+		h.memLogLock.Lock()
 		h.memLog = make([]memoryLogEntry, h.memLogSize, h.memLogSize)
+		h.memLogLock.Unlock()
+		if h.spoolDir != "" {
+			if err := recoverLogSpool(h); err != nil {
+				fmt.Printf("Memory log spool recovery for service %s failed: %s\n", h.svcName, err)
+			}
+		}
 		go func() {
 			defer h.logChanReceivers.Done()
 			entryBoundMemoryLogger(h)
 		}()
 	}
+	h.tracer.start()
 
+	if err := runHooks(context.Background(), h, startPhase); err != nil {
+		return err
+	}
+	l, err := h.listen()
+	if err != nil {
+		return err
+	}
+	serve := h.server.Serve
+	if h.server.TLSConfig != nil {
+		serve = func(l net.Listener) error { return h.server.ServeTLS(l, "", "") }
+	}
 	go func() {
-		if err := h.server.ListenAndServe(); err != nil {
-			log.Println(err)
+		if err := serve(l); err != nil && err != http.ErrServerClosed {
+			h.logger.Println(err)
+			h.serveErr <- err
 		}
 	}()
+	h.builder.mu.Lock()
 	h.startTime = time.Now()
+	h.builder.mu.Unlock()
 	atomic.StoreInt32(&h.healthy, 1)
 	atomic.StoreInt32(&h.suspended, 0)
-
-	fmt.Printf("Service %s started at port %d, start time: %s\n", h.svcName, h.port, h.startTime )
-	h.interruptChannel = make(chan os.Signal, 1)
-	signal.Notify(h.interruptChannel, os.Interrupt)
-
-	<-h.interruptChannel
-	log.Printf("Service %s shutting down\n", h.svcName)
-
-	if (!h.builder.disabledMemoryLogs) {
-		h.logChanState = 0
-		close(h.logChan)
-		h.logChanReceivers.Wait()
+	atomic.StoreInt32(&h.draining, 0)
+	if err := runHooks(context.Background(), h, readyPhase); err != nil {
+		return err
 	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), h.shutdownWait * time.Second)
-	defer cancel()
-	h.server.Shutdown(ctx)
-//	os.Exit(0)
-}
-
-// Stop - the TN Http server
-func (h *NicoServer) Stop() {
-	log.Printf("Service %s being stopped.\n", h.svcName)
-
-	if (!h.builder.disabledMemoryLogs) {
-		h.logChanState = 0
-		close(h.logChan)
-		h.logChanReceivers.Wait()
+	if h.upgradeTimeout > 0 {
+		registerUpgradeServer(h)
 	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), h.shutdownWait * time.Second)
-	defer cancel()
-	h.server.Shutdown(ctx)
-	log.SetOutput(os.Stdout)
+	upgradeServerReady(h)
+	close(h.ready)
+	return nil
 }
 
 
@@ -125,13 +268,33 @@ func (h *NicoServer) Mux() (*mux.Router) {
 }
 
 
+// Metrics - the registry exposed by /metrics, services can register their own counters and gauges
+func (h *NicoServer) Metrics() (*MetricsRegistry) {
+	return h.metrics
+}
+
+
+// Logger - the logger of the service, writing to its memory log and log sink
+func (h *NicoServer) Logger() (*log.Logger) {
+	return h.logger
+}
+
+
 // Service - returns the name of the Service used in Builder.Create() call
 func (h *NicoServer) Service() (string) {
 	return h.svcName
 }
 
 
-// Port - returns the port number used in Builder.Create() call
+// Port - returns the port the service listens on, the one used in Builder.Create() call until
+// it is listening, e.g. the port picked by the OS for port 0. 0 on a unix socket
 func (h *NicoServer) Port() (uint32) {
-	return h.port
+	switch a := h.Addr().(type) {
+		case nil:
+			return h.port
+		case *net.TCPAddr:
+			return uint32(a.Port)
+		default:
+			return 0
+	}
 }
@@ -1,8 +1,8 @@
 package nicohttp
 
 import (
+	"context"
 	"encoding/json"
-	"log"
 	"net/http"
 	"sync/atomic"
 	"time"
@@ -14,45 +14,60 @@ import (
 )
 
 func configureNonFuncRoutes(b *NicoBuilder) {
-	r := b.server.httpRouter
-	r.HandleFunc("/healthz", healthz).Methods("GET")
-	r.HandleFunc("/suspend", suspend).Methods("POST")
-	r.HandleFunc("/suspend", suspendStatus).Methods("GET")
-	r.HandleFunc("/restart", restart).Methods("POST")
-	r.HandleFunc("/shutdown", shutdown).Methods("POST")
-	r.HandleFunc("/api", api).Methods("GET")
-	r.HandleFunc("/uptime",getUpTime).Methods("GET")
-	r.HandleFunc("/builder",getBuilder).Methods("GET")
+	h := b.server
+	r := h.httpRouter
+	r.HandleFunc("/healthz", h.healthz).Methods("GET")
+	r.HandleFunc("/livez", h.livez).Methods("GET")
+	r.HandleFunc("/readyz", h.readyz).Methods("GET")
+	r.HandleFunc("/suspend", h.suspend).Methods("POST")
+	r.HandleFunc("/suspend", h.suspendStatus).Methods("GET")
+	r.HandleFunc("/restart", h.restart).Methods("POST")
+	r.HandleFunc("/shutdown", h.shutdown).Methods("POST")
+	if h.upgradeTimeout > 0 {
+		r.HandleFunc("/upgrade", h.upgrade).Methods("POST")
+	}
+	r.HandleFunc("/api", h.api).Methods("GET")
+	r.HandleFunc("/uptime", h.getUpTime).Methods("GET")
+	r.HandleFunc("/builder", h.getBuilder).Methods("GET")
+	r.HandleFunc("/metrics", h.getMetrics).Methods("GET")
+	r.HandleFunc("/breakers", h.getBreakers).Methods("GET")
 	if (!b.disabledMemoryLogs) {
-		r.HandleFunc("/logs/head/{entries}", getHead).Methods("GET")
-		r.HandleFunc("/logs/tail/{entries}", getTail).Methods("GET")
-		r.HandleFunc("/logs/size",getLogSize).Methods("GET")
-		r.HandleFunc("/dumplog",dumpLog).Methods("POST")
+		r.HandleFunc("/logs/head/{entries}", h.getHead).Methods("GET")
+		r.HandleFunc("/logs/tail/{entries}", h.getTail).Methods("GET")
+		r.HandleFunc("/logs/size", h.getLogSize).Methods("GET")
+		r.HandleFunc("/dumplog", h.dumpLog).Methods("POST")
 	}
 }
 
 
-func healthz(w http.ResponseWriter, r *http.Request) {
-	if atomic.LoadInt32(&builder.server.suspended) == 1 {
-		w.WriteHeader(http.StatusServiceUnavailable)
+func (h *NicoServer) healthz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&h.suspended) == 1 {
+		WriteProblem(w, r, http.StatusServiceUnavailable, "suspended")
+		return
+	}
+	if atomic.LoadInt32(&h.healthy) == 0 {
+		WriteProblem(w, r, http.StatusServiceUnavailable, "not started")
 		return
 	}
-	if atomic.LoadInt32(&builder.server.healthy) == 1 {
-		w.WriteHeader(http.StatusOK)
+	if criticalBreakerOpen(h) {
+		WriteProblem(w, r, http.StatusServiceUnavailable, "critical circuit breaker open")
 		return
 	}
-	w.WriteHeader(http.StatusServiceUnavailable)
+	w.WriteHeader(http.StatusOK)
 }
 
 
-func api(w http.ResponseWriter, r *http.Request) {
+func (h *NicoServer) api(w http.ResponseWriter, r *http.Request) {
 
-	apiInherited, apiService, err := generateAPI(builder.server.httpRouter)
+	apiInherited, apiService, apiGroups, err := generateAPI(h)
 	if err == nil {
-		m := map[string][]string {"base-service": apiInherited, builder.server.svcName: apiService}
+		m := map[string][]string {"base-service": apiInherited, h.svcName: apiService}
+		for prefix, routes := range apiGroups {
+			m[prefix] = routes
+		}
 		jsFinal, err3 := json.MarshalIndent(m, "", "\t")
 		if (err3 != nil) {
-			http.Error(w, err3.Error(), http.StatusInternalServerError)
+			WriteProblem(w, r, http.StatusInternalServerError, err3.Error())
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -60,29 +75,30 @@ func api(w http.ResponseWriter, r *http.Request) {
 		return
 
 	}
-	http.Error(w, err.Error(), http.StatusInternalServerError)
+	WriteProblem(w, r, http.StatusInternalServerError, err.Error())
 }
 
 
-func restart(w http.ResponseWriter, r *http.Request) {
-	if atomic.LoadInt32(&builder.server.suspended) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
+func (h *NicoServer) restart(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&h.suspended) == 0 {
+		WriteProblem(w, r, http.StatusBadRequest, "service is not suspended")
 		return
 	}
-	defer 	atomic.StoreInt32(&builder.server.suspended, 0)
-	defer func() {
-		dur := time.Since(builder.server.suspendTime)
-		builder.server.suspendDuration += dur
-	}()
+	if err := runHooks(context.Background(), h, restartPhase); err != nil {
+		WriteProblem(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.suspendDuration += time.Since(h.suspendTime)
+	atomic.StoreInt32(&h.suspended, 0)
 	w.WriteHeader(http.StatusNoContent)
-	log.Printf("API Driven restart for service: %s successful \n", builder.server.svcName)
+	h.logger.Printf("API Driven restart for service: %s successful \n", h.svcName)
 }
 
 
-func getBuilder(w http.ResponseWriter, r *http.Request) {
-	js, err := json.MarshalIndent(builder.props, "", "\t")
+func (h *NicoServer) getBuilder(w http.ResponseWriter, r *http.Request) {
+	js, err := json.MarshalIndent(h.builder.props, "", "\t")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteProblem(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -90,17 +106,17 @@ func getBuilder(w http.ResponseWriter, r *http.Request) {
 	w.Write(js)
 }
 
-func suspendStatus(w http.ResponseWriter, r *http.Request) {
+func (h *NicoServer) suspendStatus(w http.ResponseWriter, r *http.Request) {
 	var map1 map[string]bool
 
-	if atomic.LoadInt32(&builder.server.suspended) == 1 {
+	if atomic.LoadInt32(&h.suspended) == 1 {
 		map1 = map[string]bool{"suspended": true}
 	} else {
 		map1 = map[string]bool{"suspended": false}
 	}
 	js, err := json.MarshalIndent(map1, "", "\t")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteProblem(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -110,43 +126,52 @@ func suspendStatus(w http.ResponseWriter, r *http.Request) {
 
 
 
-func suspend(w http.ResponseWriter, r *http.Request) {
-	if atomic.LoadInt32(&builder.server.suspended) == 1 {
-		w.WriteHeader(http.StatusBadRequest)
+// suspend - stops the functional routes before the OnSuspend hooks run, so they may release what
+// those routes use, and serves them again if a hook fails
+func (h *NicoServer) suspend(w http.ResponseWriter, r *http.Request) {
+	if !atomic.CompareAndSwapInt32(&h.suspended, 0, 1) {
+		WriteProblem(w, r, http.StatusBadRequest, "service already suspended")
+		return
+	}
+	h.suspendTime = time.Now()
+	if err := runHooks(context.Background(), h, suspendPhase); err != nil {
+		atomic.StoreInt32(&h.suspended, 0)
+		WriteProblem(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
-	atomic.StoreInt32(&builder.server.suspended, 1)
-	builder.server.suspendTime = time.Now()
 	w.WriteHeader(http.StatusNoContent)
-	log.Printf("API Driven suspension for service: %s successful \n", builder.server.svcName)
+	h.logger.Printf("API Driven suspension for service: %s successful \n", h.svcName)
 }
 
 
-func shutdown(w http.ResponseWriter, r *http.Request) {
+func (h *NicoServer) shutdown(w http.ResponseWriter, r *http.Request) {
 
-	log.Printf("API driven shutdown triggered for service: %s: \n", builder.server.svcName)
+	h.logger.Printf("API driven shutdown triggered for service: %s: \n", h.svcName)
 	time.Sleep(1 * time.Second)
 	defer func() {
 		w.WriteHeader(http.StatusNoContent)
 	}()
-	log.Printf("API driven shutdown triggered for service: %s: \n", builder.server.svcName)
-	builder.server.server.SetKeepAlivesEnabled(false)
-	builder.server.interruptChannel <- syscall.SIGINT
+	h.logger.Printf("API driven shutdown triggered for service: %s: \n", h.svcName)
+	h.server.SetKeepAlivesEnabled(false)
+	select {
+		case h.interruptChannel <- syscall.SIGINT:
+		default: /* shutdown already requested */
+	}
 }
 
 
-func getHead(w http.ResponseWriter, r *http.Request) {
+func (h *NicoServer) getHead(w http.ResponseWriter, r *http.Request) {
 
 	entries := mux.Vars(r)["entries"]
 	nume, err := strconv.Atoi(entries)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return	
+		WriteProblemf(w, r, http.StatusBadRequest, "entries %q is not a number", entries)
+		return
 	}
-	plog := logHead(nume, builder.server) 
+	plog := logHead(nume, h) 
 	js, err := json.MarshalIndent(plog, "", "\t")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteProblem(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -154,19 +179,19 @@ func getHead(w http.ResponseWriter, r *http.Request) {
 }
 
 
-func getTail(w http.ResponseWriter, r *http.Request) {
+func (h *NicoServer) getTail(w http.ResponseWriter, r *http.Request) {
 
 	entries := mux.Vars(r)["entries"]
 	nume, err := strconv.Atoi(entries)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return	
+		WriteProblemf(w, r, http.StatusBadRequest, "entries %q is not a number", entries)
+		return
 	}
-	plog := logTail(nume, builder.server) 
+	plog := logTail(nume, h) 
 	js, err := json.MarshalIndent(plog, "", "\t")
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteProblem(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -174,13 +199,14 @@ func getTail(w http.ResponseWriter, r *http.Request) {
 }
 
 
-func getLogSize(w http.ResponseWriter, r *http.Request) {
+func (h *NicoServer) getLogSize(w http.ResponseWriter, r *http.Request) {
 
-	max, current, evicted := logSize(builder.server)
-	map1 := map[string]int {"max": max, "current": current, "evicted": evicted}
+	max, current, evicted := logSize(h)
+	map1 := map[string]int64 {"max": int64(max), "current": int64(current), "evicted": int64(evicted),
+		"nextFlush": logNextFlush(h)}
 	js, err := json.MarshalIndent(map1, "", "\t")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteProblem(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -189,15 +215,15 @@ func getLogSize(w http.ResponseWriter, r *http.Request) {
 }
 
 
-func getUpTime(w http.ResponseWriter, r *http.Request) {
+func (server *NicoServer) getUpTime(w http.ResponseWriter, r *http.Request) {
 
-	t := time.Since(builder.server.startTime)
+	t := time.Since(server.started())
 	h, m, s := decomposeDuration(t)
 	up := fmt.Sprintf("H: %d, M: %d, S: %d", h, m, s)
 
-	sut := builder.server.suspendDuration
-	if (atomic.LoadInt32(&builder.server.suspended) == 1) {
-		sut2 := time.Since(builder.server.suspendTime)
+	sut := server.suspendDuration
+	if (atomic.LoadInt32(&server.suspended) == 1) {
+		sut2 := time.Since(server.suspendTime)
 		sut += sut2
 	}
 	h, m, s = decomposeDuration(sut)
@@ -207,7 +233,7 @@ func getUpTime(w http.ResponseWriter, r *http.Request) {
 
 	js, err := json.MarshalIndent(map1, "", "\t")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteProblem(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -215,8 +241,34 @@ func getUpTime(w http.ResponseWriter, r *http.Request) {
 }
 
 
-func dumpLog(w http.ResponseWriter, r *http.Request) {
-	builder.server.logCmdChan <- dumpLogCmd
+// dumpLog - has the memory logger persist its entries to the sink and reports the outcome, giving
+// up when the client goes away or the server stops before the memory logger answers
+func (h *NicoServer) dumpLog(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadUint32(&h.logChanState) != 1 {
+		WriteProblem(w, r, http.StatusServiceUnavailable, "memory logger is not running")
+		return
+	}
+	done := make(chan error, 1)
+	select {
+		case h.logCmdChan <- logCommand{name: dumpLogCmd, done: done}:
+		case <-r.Context().Done():
+			return
+		case <-h.stopping:
+			WriteProblem(w, r, http.StatusServiceUnavailable, "server is stopping")
+			return
+	}
+	select {
+		case err := <-done:
+			if err != nil {
+				WriteProblem(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-h.stopping:
+			WriteProblem(w, r, http.StatusServiceUnavailable, "server is stopping")
+			return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -0,0 +1,197 @@
+package nicohttp
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	// MetricsStage - built-in stage counting requests and latencies for /metrics
+	MetricsStage string = "metrics"
+	// SuspendStage - built-in stage answering 503 while the service is suspended
+	SuspendStage string = "suspend"
+	// LoggingStage - built-in stage writing the access log to the memory log
+	LoggingStage string = "logging"
+	// TracingStage - built-in stage assigning request IDs and server spans
+	TracingStage string = "tracing"
+	// RecoveryStage - built-in stage turning handler panics into 500 problem+json responses
+	RecoveryStage string = "recovery"
+	// AuthStage - built-in stage authenticating the request (WithAuthNMediator)
+	AuthStage string = "auth"
+	// TimeoutStage - built-in stage bounding the time handlers have to respond
+	TimeoutStage string = "timeout"
+	// BodyLimitStage - built-in stage answering requests with a body over the limit with a 413
+	BodyLimitStage string = "bodyLimit"
+)
+
+// Middleware - a mediator wrapping the next handler of the pipeline
+type Middleware func(next http.Handler) http.Handler
+
+type stage struct {
+	name string
+	mediator Middleware
+	off bool /* built-in stage turned off, kept as an anchor for inserts */
+}
+
+
+// WithMiddlewareBefore - insert the named middleware right before (outside of) the named stage,
+// which can be a built-in stage or a previously inserted middleware
+func (b *NicoBuilder) WithMiddlewareBefore(stage, name string, f Middleware) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.insertStage(stage, 0, name, f)
+	return b
+}
+
+
+// WithMiddlewareAfter - insert the named middleware right after (inside of) the named stage,
+// which can be a built-in stage or a previously inserted middleware
+func (b *NicoBuilder) WithMiddlewareAfter(stage, name string, f Middleware) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.insertStage(stage, 1, name, f)
+	return b
+}
+
+
+// WithoutMiddleware - remove the named stage or middleware from the pipeline
+func (b *NicoBuilder) WithoutMiddleware(name string) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	if i := b.stageIndex(name); i >= 0 {
+		b.chain = append(b.chain[:i], b.chain[i+1:]...)
+		b.updatePipelineProps()
+		return b
+	}
+	b.pipelineError(name)
+	return b
+}
+
+
+// WithMiddlewareReplaced - replace the mediator of the named stage or middleware, keeping its
+// name and position in the pipeline
+func (b *NicoBuilder) WithMiddlewareReplaced(name string, f Middleware) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.setStage(name, f)
+	return b
+}
+
+
+// Pipeline - names of the stages a request goes through, outermost first
+func (b *NicoBuilder) Pipeline() ([]string) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	return b.pipeline()
+}
+
+
+func (b *NicoBuilder) initDefaultHandlerChain() {
+	b.chain = []stage{
+		{name: MetricsStage, mediator: b.server.metricsMediator},
+		{name: SuspendStage, mediator: b.server.suspendMediator},
+		{name: LoggingStage, mediator: b.server.memoryPostLoggingMediator},
+		{name: TracingStage, mediator: b.server.tracingMediator},
+		{name: RecoveryStage, mediator: b.server.recoveryMediator},
+		{name: BodyLimitStage, mediator: b.server.bodyLimitMediator},
+		{name: AuthStage, mediator: noAuthMediator},
+		{name: TimeoutStage, mediator: b.server.timeoutMediator},
+	}
+	b.updatePipelineProps()
+}
+
+
+func (b *NicoBuilder) stageIndex(name string) int {
+	for i := range b.chain {
+		if b.chain[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+
+// insertStage - inserts at offset 0 (before) or 1 (after) of anchor. The name must not be taken
+// by another stage, built-in ones included
+func (b *NicoBuilder) insertStage(anchor string, offset int, name string, f Middleware) {
+	if b.stageTaken(name, -1) {
+		return
+	}
+	i := b.stageIndex(anchor)
+	if i < 0 {
+		b.pipelineError(anchor)
+		return
+	}
+	i += offset
+	b.chain = append(b.chain[:i], append([]stage{{name: name, mediator: f}}, b.chain[i:]...)...)
+	b.updatePipelineProps()
+}
+
+
+// stageTaken - true, recording the error Create returns, if a stage other than the one at index
+// except is named name
+func (b *NicoBuilder) stageTaken(name string, except int) bool {
+	if i := b.stageIndex(name); i < 0 || i == except {
+		return false
+	}
+	if b.err == nil {
+		b.err = fmt.Errorf("stage %s already in the pipeline %v", name, b.pipeline())
+	}
+	return true
+}
+
+
+// setStage - sets the mediator of a stage and turns it on. A stage removed with WithoutMiddleware
+// is an error Create returns, rather than an option silently left out
+func (b *NicoBuilder) setStage(name string, f Middleware) {
+	i := b.stageIndex(name)
+	if i < 0 {
+		b.pipelineError(name)
+		return
+	}
+	b.chain[i].mediator = f
+	b.chain[i].off = false
+	b.updatePipelineProps()
+}
+
+
+func (b *NicoBuilder) turnOffStage(name string) {
+	if i := b.stageIndex(name); i >= 0 {
+		b.chain[i].off = true
+		b.updatePipelineProps()
+	}
+}
+
+
+func (b *NicoBuilder) pipeline() ([]string) {
+	names := make([]string, 0, len(b.chain))
+	for _, s := range b.chain {
+		if !s.off {
+			names = append(names, s.name)
+		}
+	}
+	return names
+}
+
+
+func (b *NicoBuilder) updatePipelineProps() {
+	b.props[PipelineKey] = b.pipeline()
+}
+
+
+func (b *NicoBuilder) pipelineError(name string) {
+	if b.err == nil {
+		b.err = fmt.Errorf("no stage %s in the pipeline %v", name, b.pipeline())
+	}
+}
+
+
+// wrap - wraps next with the stages that are on, the first stage being the outermost
+func (b *NicoBuilder) wrap(next http.Handler) http.Handler {
+	for i := len(b.chain) - 1; i >= 0; i-- {
+		if !b.chain[i].off {
+			next = b.chain[i].mediator(next)
+		}
+	}
+	return next
+}
@@ -0,0 +1,133 @@
+package nicohttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+
+func recordingMiddleware(order *[]string, name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*order = append(*order, name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+
+func TestPipelineOrder(t *testing.T) {
+	var order []string
+	b := GetBuilder().WithDefaults().WithNoMemoryLogger().
+		WithMiddlewareBefore(AuthStage, "cors", recordingMiddleware(&order, "cors")).
+		WithMiddlewareAfter(AuthStage, "authz", recordingMiddleware(&order, "authz")).
+		WithMiddlewareAfter("authz", "audit", recordingMiddleware(&order, "audit")).
+		WithCustomPreMediator("pre", recordingMiddleware(&order, "pre")).
+		WithCustomPostMediator("post", recordingMiddleware(&order, "post")).
+		WithMiddlewareReplaced(AuthStage, recordingMiddleware(&order, AuthStage)).
+		WithoutMiddleware(MetricsStage)
+
+	expected := []string{"post", SuspendStage, TracingStage, RecoveryStage, BodyLimitStage, "cors", AuthStage, "authz", "audit", TimeoutStage, "pre"}
+	if actual := b.Pipeline(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("%s: expected = %v, actual = %v", t.Name(), expected, actual)
+	}
+	srv, err := b.Create(t.Name(), 0)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	srv.Mux().HandleFunc("/regions", func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	})
+	srv.server.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/regions", nil))
+	if expected := []string{"post", "cors", AuthStage, "authz", "audit", "pre", "handler"}; !reflect.DeepEqual(order, expected) {
+		t.Fatalf("%s: expected = %v, actual = %v", t.Name(), expected, order)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.getBuilder(rec, httptest.NewRequest(http.MethodGet, "/builder", nil))
+	var props map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &props); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if len(props[PipelineKey].([]interface{})) != 11 {
+		t.Fatalf("%s: /builder pipeline = %v", t.Name(), props[PipelineKey])
+	}
+}
+
+
+func TestPipelineTimeoutStage(t *testing.T) {
+	b := GetBuilder().WithDefaults().WithNoMemoryLogger()
+	if expected := []string{MetricsStage, SuspendStage, TracingStage, RecoveryStage, BodyLimitStage, AuthStage, TimeoutStage}; !reflect.DeepEqual(b.Pipeline(), expected) {
+		t.Fatalf("%s: expected = %v, actual = %v", t.Name(), expected, b.Pipeline())
+	}
+	b.WithMiddlewareBefore(TimeoutStage, "cache", noopHandler).WithoutMiddleware(TimeoutStage)
+	if expected := []string{MetricsStage, SuspendStage, TracingStage, RecoveryStage, BodyLimitStage, AuthStage, "cache"}; !reflect.DeepEqual(b.Pipeline(), expected) {
+		t.Fatalf("%s: expected = %v, actual = %v", t.Name(), expected, b.Pipeline())
+	}
+}
+
+
+func TestPipelineUnknownStage(t *testing.T) {
+	_, err := GetBuilder().WithDefaults().WithNoMemoryLogger().
+		WithMiddlewareAfter("compression", "etag", noopHandler).Create(t.Name(), 0)
+	if err == nil {
+		t.Fatalf("%s: expected an error for an unknown stage", t.Name())
+	}
+}
+
+
+func TestPipelineNameClash(t *testing.T) {
+	for _, name := range []string{AuthStage, "cors"} {
+		b := GetBuilder().WithDefaults().WithNoMemoryLogger().
+			WithMiddlewareBefore(AuthStage, "cors", noopHandler).
+			WithMiddlewareBefore(TracingStage, name, noopHandler)
+		if expected := []string{MetricsStage, SuspendStage, TracingStage, RecoveryStage, BodyLimitStage, "cors", AuthStage, TimeoutStage}; !reflect.DeepEqual(b.Pipeline(), expected) {
+			t.Fatalf("%s: %s: expected = %v, actual = %v", t.Name(), name, expected, b.Pipeline())
+		}
+		if _, err := b.Create(t.Name(), 0); err == nil {
+			t.Fatalf("%s: expected an error for the name %s already in the pipeline", t.Name(), name)
+		}
+	}
+}
+
+
+func TestPipelineRemovedStage(t *testing.T) {
+	for name, b := range map[string]*NicoBuilder{
+		AuthStage: GetBuilder().WithDefaults().WithNoMemoryLogger().WithoutMiddleware(AuthStage).WithAuthNMediator(BASIC, ""),
+		LoggingStage: GetBuilder().WithDefaults().WithoutMiddleware(LoggingStage).WithMemoryLogger(EntryBound, 10),
+		TracingStage: GetBuilder().WithDefaults().WithNoMemoryLogger().WithoutMiddleware(TracingStage).WithTracing(),
+		TimeoutStage: GetBuilder().WithDefaults().WithNoMemoryLogger().WithoutMiddleware(TimeoutStage).WithTimeoutHandler(time.Second),
+	} {
+		/* the option would silently do nothing, with the props claiming otherwise */
+		if _, err := b.Create(t.Name(), 0); err == nil || !strings.Contains(err.Error(), "no stage " + name) {
+			t.Fatalf("%s: %s: expected a missing stage error, got %v", t.Name(), name, err)
+		}
+	}
+}
+
+
+func TestCustomMediatorNameClash(t *testing.T) {
+	pre := GetBuilder().WithDefaults().WithNoMemoryLogger().WithCustomPreMediator(AuthStage, noopHandler)
+	post := GetBuilder().WithDefaults().WithNoMemoryLogger().WithCustomPreMediator("cors", noopHandler).
+		WithCustomPostMediator("cors", noopHandler)
+	for name, b := range map[string]*NicoBuilder{"pre": pre, "post": post} {
+		if _, err := b.Create(t.Name(), 0); err == nil || !strings.Contains(err.Error(), "already in the pipeline") {
+			t.Fatalf("%s: %s: expected a name clash error, got %v", t.Name(), name, err)
+		}
+	}
+	if expected := []string{MetricsStage, SuspendStage, TracingStage, RecoveryStage, BodyLimitStage, AuthStage, TimeoutStage}; !reflect.DeepEqual(pre.Pipeline(), expected) {
+		t.Fatalf("%s: expected = %v, actual = %v", t.Name(), expected, pre.Pipeline())
+	}
+
+	/* replacing a custom mediator with one of the same name is no clash */
+	b := GetBuilder().WithDefaults().WithNoMemoryLogger().WithCustomPreMediator("cors", noopHandler).
+		WithCustomPreMediator("cors", noopHandler)
+	if _, err := b.Create(t.Name(), 0); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+}
@@ -0,0 +1,93 @@
+package nicohttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// ProblemJSON - media type of RFC 7807 problem details
+	ProblemJSON string = "application/problem+json"
+	// DefaultProblemType - problem type when the status code is all the client needs to know
+	DefaultProblemType string = "about:blank"
+)
+
+// Problem - RFC 7807 problem details, the error response of the framework. The request ID ties
+// the response to the access log entry of the request
+type Problem struct {
+	Type string `json:"type"`
+	Title string `json:"title"`
+	Status int `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	RequestID string `json:"requestID,omitempty"`
+}
+
+
+// NewProblem - problem details for the status of a response to r, of DefaultProblemType and
+// titled after the status. Set Type and Title for problems specific to the service
+func NewProblem(r *http.Request, status int, detail string) (*Problem) {
+	requestID := RequestID(r.Context())
+	if requestID == "" && validRequestID(r.Header.Get(requestIDHeader)) {
+		requestID = r.Header.Get(requestIDHeader)
+	}
+	return &Problem{
+		Type: DefaultProblemType,
+		Title: http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Instance: r.URL.Path,
+		RequestID: requestID,
+	}
+}
+
+
+// Write - writes the problem as an application/problem+json response
+func (p *Problem) Write(w http.ResponseWriter) {
+	js, err := json.Marshal(p)
+	if err != nil {
+		js = []byte(fmt.Sprintf(`{"type":%q,"title":%q,"status":%d}`, DefaultProblemType,
+			http.StatusText(p.Status), p.Status))
+	}
+	w.Header().Set("Content-Type", ProblemJSON)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	w.Write(js)
+}
+
+
+// Error - the problem as an error message
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return fmt.Sprintf("%d %s", p.Status, p.Title)
+	}
+	return fmt.Sprintf("%d %s: %s", p.Status, p.Title, p.Detail)
+}
+
+
+// WriteProblem - replies to r with problem details for the status, the replacement of http.Error
+// for handlers answering with the same error shape as the framework
+func WriteProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	NewProblem(r, status, detail).Write(w)
+}
+
+
+// WriteProblemf - WriteProblem with a formatted detail
+func WriteProblemf(w http.ResponseWriter, r *http.Request, status int, format string, v ...interface{}) {
+	NewProblem(r, status, fmt.Sprintf(format, v...)).Write(w)
+}
+
+
+func notFoundHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteProblemf(w, r, http.StatusNotFound, "no route for %s", r.URL.Path)
+	})
+}
+
+
+func methodNotAllowedHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteProblemf(w, r, http.StatusMethodNotAllowed, "%s not allowed on %s", r.Method, r.URL.Path)
+	})
+}
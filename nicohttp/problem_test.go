@@ -0,0 +1,47 @@
+package nicohttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+
+func TestProblemResponses(t *testing.T) {
+	srv, _ := GetBuilder().WithDefaults().Create(t.Name(), 0)
+	srv.Mux().HandleFunc("/regions", func(w http.ResponseWriter, r *http.Request) {
+		WriteProblemf(w, r, http.StatusConflict, "region %s exists", "us-east")
+	}).Methods("POST")
+
+	tests := []struct {
+		method, uri string
+		status int
+		detail string
+	}{
+		{http.MethodPost, "/regions", http.StatusConflict, "region us-east exists"},
+		{http.MethodGet, "/regions", http.StatusMethodNotAllowed, "GET not allowed on /regions"},
+		{http.MethodGet, "/zones", http.StatusNotFound, "no route for /zones"},
+		{http.MethodGet, "/logs/head/ten", http.StatusBadRequest, `entries "ten" is not a number`},
+		{http.MethodPost, "/restart", http.StatusBadRequest, "service is not suspended"},
+		{http.MethodPost, "/suspend", http.StatusNoContent, ""},
+		{http.MethodPost, "/regions", http.StatusServiceUnavailable, "temporarily suspended"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.uri, nil))
+		if rec.Code != tt.status {
+			t.Fatalf("%s: %s %s expected = %d, actual = %d", t.Name(), tt.method, tt.uri, tt.status, rec.Code)
+		}
+		if tt.detail == "" {
+			continue
+		}
+		var p Problem
+		if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil || rec.Header().Get("Content-Type") != ProblemJSON {
+			t.Fatalf("%s: %s %s not a problem: %s", t.Name(), tt.method, tt.uri, rec.Body.String())
+		}
+		if p.Status != tt.status || p.Detail != tt.detail || p.Type != DefaultProblemType || p.Instance != tt.uri {
+			t.Fatalf("%s: unexpected problem %+v", t.Name(), p)
+		}
+	}
+}
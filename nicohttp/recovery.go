@@ -0,0 +1,93 @@
+package nicohttp
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// PanicReport - a handler panic recovered by the recovery stage
+type PanicReport struct {
+	Service string
+	RequestID string
+	Method string
+	URI string
+	Route string
+	Value interface{}
+	Stack []byte
+	Time time.Time
+}
+
+// PanicReporter - sends crash reports, e.g. to an error tracking service. Called asynchronously
+// once per recovered panic
+type PanicReporter func(ctx context.Context, report PanicReport)
+
+
+// WithPanicReporter - require custom HTTP Server to send a crash report for every recovered
+// handler panic
+func (b *NicoBuilder) WithPanicReporter(name string, reporter PanicReporter) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.server.panicReporter = reporter
+	b.props[PanicReporterKey] = name
+	return b
+}
+
+
+// recoveryMediator - answers a handler panic with a 500 problem+json carrying the request ID,
+// logs its stack at error level to the memory log and flushes it, counts it and reports it. The connection is
+// aborted if the response had already started
+func (h *NicoServer) recoveryMediator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := statusResponseWriter{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			report := PanicReport{
+				Service: h.svcName,
+				RequestID: RequestID(r.Context()),
+				Method: r.Method,
+				URI: r.RequestURI,
+				Route: routeName(h.httpRouter, r),
+				Value: err,
+				Stack: debug.Stack(),
+				Time: time.Now(),
+			}
+			route := report.Route
+			if route == "" {
+				route = "unmatched"
+			}
+			h.serverMetrics.panics.Inc(route, methodLabel(r.Method))
+			h.logger.Printf("level=error requestID=%s panic serving %s %s: %v\n%s", report.RequestID, r.Method,
+				r.RequestURI, err, report.Stack)
+			if reporter := h.panicReporter; reporter != nil {
+				go reportPanic(h, reporter, report)
+			}
+			flushAfterPanic(h)
+			if sw.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			WriteProblem(w, r, http.StatusInternalServerError, "the request could not be completed")
+		}()
+		next.ServeHTTP(&sw, r)
+	})
+}
+
+
+func reportPanic(server *NicoServer, reporter PanicReporter, report PanicReport) {
+	defer func() {
+		if err := recover(); err != nil {
+			server.logger.Printf("level=error panic reporter failed: %v\n", err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), defaultHookTimeout)
+	defer cancel()
+	reporter(ctx, report)
+}
+
@@ -0,0 +1,51 @@
+package nicohttp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+
+func TestRecoveryStage(t *testing.T) {
+	reports := make(chan PanicReport, 1)
+	srv, _ := GetBuilder().WithDefaults().WithNoMemoryLogger().
+		WithPanicReporter("test", func(ctx context.Context, report PanicReport) { reports <- report }).
+		Create(t.Name(), 0)
+	var logged strings.Builder
+	srv.Logger().SetOutput(&logged)
+	srv.Mux().HandleFunc("/regions", func(w http.ResponseWriter, r *http.Request) {
+		panic("nil map")
+	}).Name("regions")
+
+	rec := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/regions", nil))
+	var p Problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if rec.Code != http.StatusInternalServerError || rec.Header().Get("Content-Type") != ProblemJSON ||
+		p.Status != http.StatusInternalServerError || p.RequestID == "" || p.RequestID != rec.Header().Get(requestIDHeader) {
+		t.Fatalf("%s: unexpected response %d %s", t.Name(), rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(logged.String(), "level=error requestID="+p.RequestID) || !strings.Contains(logged.String(), "goroutine") {
+		t.Fatalf("%s: stack not logged, actual = %s", t.Name(), logged.String())
+	}
+	rec = httptest.NewRecorder()
+	srv.getMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `nicohttp_http_panics_total{route="regions",method="GET"} 1`) {
+		t.Fatalf("%s: panic not counted", t.Name())
+	}
+	select {
+		case report := <-reports:
+			if report.RequestID != p.RequestID || report.Route != "regions" || report.Value != "nil map" {
+				t.Fatalf("%s: unexpected report %+v", t.Name(), report)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: panic not reported", t.Name())
+	}
+}
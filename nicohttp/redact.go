@@ -0,0 +1,156 @@
+package nicohttp
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	redactedValue string = "[REDACTED]"
+)
+
+var (
+	// BearerTokenPattern - bearer tokens, e.g. in a logged Authorization header
+	BearerTokenPattern = regexp.MustCompile(`(?i)\bbearer\s+[a-z0-9\-._~+/]+=*`)
+	// EmailPattern - email addresses
+	EmailPattern = regexp.MustCompile(`(?i)\b[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,}\b`)
+	// CardNumberPattern - candidate payment card numbers, only matches passing the Luhn check are redacted
+	CardNumberPattern = regexp.MustCompile(`\b\d(?:[ \-]?\d){12,18}\b`)
+)
+
+type redactionRule struct {
+	name string
+	re *regexp.Regexp
+	repl string
+	validate func(match string) bool
+}
+
+// Redactor - rules applied to access and application log entries before they enter the memory
+// log or any sink. Rules are applied in the order they were added
+type Redactor struct {
+	rules []redactionRule
+}
+
+
+// NewRedactor - returns a Redactor without any rules
+func NewRedactor() (*Redactor) {
+	return &Redactor{}
+}
+
+
+// DefaultRedactor - returns a Redactor for the usual suspects: credentials passed as query
+// parameters or headers, and bearer tokens
+func DefaultRedactor() (*Redactor) {
+	return NewRedactor().
+		WithQueryParams("access_token", "token", "id_token", "password", "passwd", "secret", "api_key", "apikey", "key").
+		WithHeaders("Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key").
+		WithBearerTokens()
+}
+
+
+// WithQueryParams - redact the values of the named query parameters wherever a query string appears
+func (rd *Redactor) WithQueryParams(names ...string) (*Redactor) {
+	for _, n := range names {
+		re := regexp.MustCompile(`(?i)([?&;]` + regexp.QuoteMeta(n) + `=)[^&;#\s"]*`)
+		rd.rules = append(rd.rules, redactionRule{name: "query:" + n, re: re, repl: "${1}" + redactedValue})
+	}
+	return rd
+}
+
+
+// WithHeaders - redact the values of the named headers wherever they are logged as "Name: value"
+// or "Name=value"
+func (rd *Redactor) WithHeaders(names ...string) (*Redactor) {
+	for _, n := range names {
+		re := regexp.MustCompile(`(?i)(\b` + regexp.QuoteMeta(n) + `"?\s*[:=]\s*"?)(?:(?:bearer|basic|digest)\s+)?[^\s",;&]+`)
+		rd.rules = append(rd.rules, redactionRule{name: "header:" + n, re: re, repl: "${1}" + redactedValue})
+	}
+	return rd
+}
+
+
+// WithBearerTokens - redact bearer tokens
+func (rd *Redactor) WithBearerTokens() (*Redactor) {
+	return rd.WithPattern("bearer", BearerTokenPattern)
+}
+
+
+// WithEmails - redact email addresses
+func (rd *Redactor) WithEmails() (*Redactor) {
+	return rd.WithPattern("email", EmailPattern)
+}
+
+
+// WithCardNumbers - redact payment card numbers
+func (rd *Redactor) WithCardNumbers() (*Redactor) {
+	rd.rules = append(rd.rules, redactionRule{name: "card", re: CardNumberPattern, repl: redactedValue, validate: luhnValid})
+	return rd
+}
+
+
+// WithPattern - redact every match of re
+func (rd *Redactor) WithPattern(name string, re *regexp.Regexp) (*Redactor) {
+	rd.rules = append(rd.rules, redactionRule{name: name, re: re, repl: redactedValue})
+	return rd
+}
+
+
+// Redact - returns s with all rules applied
+func (rd *Redactor) Redact(s string) string {
+	if rd == nil {
+		return s
+	}
+	for _, rule := range rd.rules {
+		if rule.validate == nil {
+			s = rule.re.ReplaceAllString(s, rule.repl)
+			continue
+		}
+		s = rule.re.ReplaceAllStringFunc(s, func(m string) string {
+			if rule.validate(m) {
+				return rule.repl
+			}
+			return m
+		})
+	}
+	return s
+}
+
+
+// String - the rules of the Redactor, as presented by /builder
+func (rd *Redactor) String() string {
+	if rd == nil || len(rd.rules) == 0 {
+		return "None"
+	}
+	names := make([]string, 0, len(rd.rules))
+	for _, rule := range rd.rules {
+		names = append(names, rule.name)
+	}
+	return strings.Join(names, ",")
+}
+
+
+func luhnValid(s string) bool {
+	sum := 0
+	digits := 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if digits%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+	}
+	return digits >= 13 && sum%10 == 0
+}
+
+
+func redactLogEntry(server *NicoServer, msg string) string {
+	return server.redactor.Redact(msg)
+}
@@ -0,0 +1,87 @@
+package nicohttp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	requestIDHeader string = "X-Request-ID"
+	maxRequestIDLength int = 128
+)
+
+type requestIDContextKey struct{}
+type serverContextKey struct{}
+
+
+// newRequestID - UUIDv7 (RFC 9562): 48 bit millisecond timestamp followed by 74 random bits, so IDs
+// sort by creation time and do not collide under load
+func newRequestID() string {
+	var u [16]byte
+	binary.BigEndian.PutUint64(u[0:8], uint64(time.Now().UnixMilli())<<16)
+	if _, err := rand.Read(u[6:]); err != nil {
+		panic(err)
+	}
+	u[6] = (u[6] & 0x0f) | 0x70 /* version 7 */
+	u[8] = (u[8] & 0x3f) | 0x80 /* RFC 4122 variant */
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+
+// validRequestID - incoming IDs are only trusted if short and printable, anything else is replaced
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+
+// RequestID - the ID of the request being served, "" if ctx does not belong to a request
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+
+// ContextWithRequestID - returns a copy of ctx carrying the request ID
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+
+// Logf - log.Printf prefixed with the request ID found in ctx, so application log entries in
+// the memory log can be correlated with the access log entry of the same request. Entries go to
+// the logger of the server handling the request
+func Logf(ctx context.Context, format string, v ...interface{}) {
+	logf := log.Printf
+	if server := serverFromContext(ctx); server != nil {
+		logf = server.logger.Printf
+	}
+	if id := RequestID(ctx); id != "" {
+		logf("requestID=%s "+format, append([]interface{}{id}, v...)...)
+		return
+	}
+	logf(format, v...)
+}
+
+
+// contextWithServer - ctx carrying the server handling the request
+func contextWithServer(ctx context.Context, server *NicoServer) context.Context {
+	return context.WithValue(ctx, serverContextKey{}, server)
+}
+
+
+func serverFromContext(ctx context.Context) *NicoServer {
+	s, _ := ctx.Value(serverContextKey{}).(*NicoServer)
+	return s
+}
@@ -0,0 +1,65 @@
+package nicohttp
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var uuidV7 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+
+func TestNewRequestID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		id := newRequestID()
+		if !uuidV7.MatchString(id) {
+			t.Fatalf("%s: %s is not a UUIDv7", t.Name(), id)
+		}
+		if seen[id] {
+			t.Fatalf("%s: duplicate request ID %s", t.Name(), id)
+		}
+		seen[id] = true
+	}
+}
+
+
+func TestRequestIDOnContextAndResponse(t *testing.T) {
+	b := GetBuilder().WithDefaults()
+	var ctxID string
+	h := b.server.tracingMediator(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctxID = RequestID(r.Context())
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/regions", nil))
+	if !uuidV7.MatchString(ctxID) || rec.Header().Get(requestIDHeader) != ctxID {
+		t.Fatalf("%s: context ID = %s, response ID = %s", t.Name(), ctxID, rec.Header().Get(requestIDHeader))
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/regions", nil)
+	req.Header.Set(requestIDHeader, "upstream-id-1")
+	h.ServeHTTP(rec, req)
+	if ctxID != "upstream-id-1" || rec.Header().Get(requestIDHeader) != "upstream-id-1" {
+		t.Fatalf("%s: incoming request ID not honoured, actual = %s", t.Name(), ctxID)
+	}
+}
+
+
+func TestLogf(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stdout)
+
+	Logf(ContextWithRequestID(context.Background(), "rid-1"), "fetched %d regions", 3)
+	if !strings.Contains(buf.String(), "requestID=rid-1 fetched 3 regions") {
+		t.Fatalf("%s: unexpected log line %q", t.Name(), buf.String())
+	}
+}
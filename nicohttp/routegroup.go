@@ -0,0 +1,113 @@
+package nicohttp
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// RouteGroup - routes under a path prefix sharing their own middlewares, e.g. an /admin group
+// with stricter auth. The group's middlewares wrap its handlers inside the pipeline
+type RouteGroup struct {
+	prefix string
+	server *NicoServer
+	route *mux.Route
+	router *mux.Router
+	middlewares []string
+}
+
+
+// Group - creates a route group for the path prefix on the service mux
+func (h *NicoServer) Group(prefix string) (*RouteGroup) {
+	return h.newGroup(h.httpRouter, "", prefix)
+}
+
+
+// Group - creates a nested route group for the path prefix, relative to the group's prefix. Its
+// middlewares run inside the middlewares of g
+func (g *RouteGroup) Group(prefix string) (*RouteGroup) {
+	return g.server.newGroup(g.router, g.prefix, prefix)
+}
+
+
+// Use - appends the named middleware to the group, the first middleware being the outermost
+func (g *RouteGroup) Use(name string, f Middleware) (*RouteGroup) {
+	g.router.Use(mux.MiddlewareFunc(f))
+	g.middlewares = append(g.middlewares, name)
+	g.server.updateGroupProps()
+	return g
+}
+
+
+// HandleFunc - registers the handler for the path, relative to the group's prefix
+func (g *RouteGroup) HandleFunc(path string, f func(http.ResponseWriter, *http.Request)) (*mux.Route) {
+	return g.router.HandleFunc(path, f)
+}
+
+
+// Handle - registers the handler for the path, relative to the group's prefix
+func (g *RouteGroup) Handle(path string, handler http.Handler) (*mux.Route) {
+	return g.router.Handle(path, handler)
+}
+
+
+// Router - the mux subrouter of the group
+func (g *RouteGroup) Router() (*mux.Router) {
+	return g.router
+}
+
+
+// Prefix - the full path prefix of the group
+func (g *RouteGroup) Prefix() (string) {
+	return g.prefix
+}
+
+
+func (h *NicoServer) newGroup(parent *mux.Router, parentPrefix, prefix string) (*RouteGroup) {
+	route := parent.PathPrefix(prefix)
+	g := &RouteGroup{prefix: parentPrefix + prefix, server: h, route: route, router: route.Subrouter()}
+	defer h.builder.mu.Unlock()
+	h.builder.mu.Lock()
+	h.groups = append(h.groups, g)
+	return g
+}
+
+
+// groupOfRoute - the innermost group a route belongs to, nil if none
+func (h *NicoServer) groupOfRoute(ancestors []*mux.Route) (*RouteGroup) {
+	defer h.builder.mu.Unlock()
+	h.builder.mu.Lock()
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		for _, g := range h.groups {
+			if g.route == ancestors[i] {
+				return g
+			}
+		}
+	}
+	return nil
+}
+
+
+// groupByRoute - the group whose prefix route is route, nil if none
+func (h *NicoServer) groupByRoute(route *mux.Route) (*RouteGroup) {
+	defer h.builder.mu.Unlock()
+	h.builder.mu.Lock()
+	for _, g := range h.groups {
+		if g.route == route {
+			return g
+		}
+	}
+	return nil
+}
+
+
+func (h *NicoServer) updateGroupProps() {
+	defer h.builder.mu.Unlock()
+	h.builder.mu.Lock()
+	groups := make(map[string]string)
+	for _, g := range h.groups {
+		groups[g.prefix] = strings.Join(g.middlewares, ",")
+	}
+	h.builder.props[RouteGroupsKey] = groups
+}
@@ -0,0 +1,66 @@
+package nicohttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+
+func TestRouteGroups(t *testing.T) {
+	srv, _ := GetBuilder().WithDefaults().WithNoMemoryLogger().Create(t.Name(), 0)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	var order []string
+	admin := srv.Group("/admin").
+		Use("adminAuth", func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Admin") == "" {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		}).
+		Use("audit", recordingMiddleware(&order, "audit"))
+	admin.HandleFunc("/users", ok).Methods("GET")
+	admin.Group("/ops").Use("ops", recordingMiddleware(&order, "ops")).HandleFunc("/drain", ok).Methods("POST")
+	srv.Group("/public").Use("cache", recordingMiddleware(&order, "cache")).HandleFunc("/regions", ok).Methods("GET")
+	srv.Mux().HandleFunc("/regions", ok).Methods("GET")
+
+	serve := func(method, uri string, admin bool) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, uri, nil)
+		if admin {
+			req.Header.Set("X-Admin", "1")
+		}
+		srv.server.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := serve(http.MethodGet, "/admin/users", false); rec.Code != http.StatusForbidden {
+		t.Fatalf("%s: admin group middleware not applied, status = %d", t.Name(), rec.Code)
+	}
+	if rec := serve(http.MethodPost, "/admin/ops/drain", true); rec.Code != http.StatusOK || rec.Header().Get(requestIDHeader) == "" {
+		t.Fatalf("%s: expected 200 through the global pipeline, status = %d", t.Name(), rec.Code)
+	}
+	serve(http.MethodGet, "/regions", false)
+	serve(http.MethodGet, "/public/regions", false)
+	if expected := []string{"audit", "ops", "cache"}; !reflect.DeepEqual(order, expected) {
+		t.Fatalf("%s: expected = %v, actual = %v", t.Name(), expected, order)
+	}
+
+	rec := serve(http.MethodGet, "/api", false)
+	var api map[string][]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &api); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if len(api["/admin"]) != 1 || !strings.HasSuffix(api["/admin/ops"][0], "/admin/ops/drain") ||
+		len(api["/public"]) != 1 || len(api[t.Name()]) != 1 {
+		t.Fatalf("%s: routes not grouped, actual = %v", t.Name(), api)
+	}
+	if g := srv.Builder().Props()[RouteGroupsKey].(map[string]string); g["/admin"] != "adminAuth,audit" {
+		t.Fatalf("%s: unexpected groups %v", t.Name(), g)
+	}
+}
@@ -0,0 +1,116 @@
+package nicohttp
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+
+func TestRunBindError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	defer l.Close()
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+	srv, _ := GetBuilder().WithDefaults().WithNoMemoryLogger().Create(t.Name(), port)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(context.Background())
+	}()
+	select {
+		case <-srv.Ready():
+			if srv.Err() == nil {
+				t.Fatalf("%s: ready without the port in use error", t.Name())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: Ready not closed on the bind error", t.Name())
+	}
+	if err := <-done; err == nil || err != srv.Err() {
+		t.Fatalf("%s: expected the port in use error, actual = %v", t.Name(), err)
+	}
+}
+
+
+func TestEmptyShutdownSignals(t *testing.T) {
+	b := GetBuilder().WithDefaults().WithShutdownSignals()
+	if !reflect.DeepEqual(b.server.signals, defaultShutdownSignals) {
+		t.Fatalf("%s: signals %v, expected the defaults", t.Name(), b.server.signals)
+	}
+}
+
+
+func TestRunStopsOnContext(t *testing.T) {
+	p := getLoggerPort()
+	srv, _ := GetBuilder().WithDefaults().Create(t.Name(), p)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(ctx)
+	}()
+	<-srv.Ready()
+
+	resp, err := http.Get(getTarget(p, uriHealthz))
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	resp.Body.Close()
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	if _, err := http.Get(getTarget(p, uriHealthz)); err == nil {
+		t.Fatalf("%s: service still listening after Run returned", t.Name())
+	}
+}
+
+
+func TestIndependentServers(t *testing.T) {
+	var srvs [2]*NicoServer
+	var regions [2]*string
+	var ports [2]uint32
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i, region := range []string{"us-east", "eu-west"} {
+		fs := flag.NewFlagSet(region, flag.ContinueOnError)
+		b, r := GetBuilder().WithDefaults().WithNoMemoryLogger().WithoutStdLog().WithFlagSet(fs).
+			WithStringFlag("region", "", "region served", false)
+		fs.Parse([]string{"-region", region})
+		ports[i], regions[i] = getLoggerPort(), r
+		srvs[i], _ = b.Create(fmt.Sprintf("%s-%d", t.Name(), i), ports[i])
+		served := regions[i]
+		srvs[i].Mux().HandleFunc("/region", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, *served)
+		})
+		go srvs[i].Run(ctx)
+		<-srvs[i].Ready()
+	}
+
+	resp, err := http.Post(getTarget(ports[0], "/suspend"), "", nil)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	resp.Body.Close()
+	for i, expected := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		resp, err := http.Get(getTarget(ports[i], "/region"))
+		if err != nil {
+			t.Fatalf("%s: %s", t.Name(), err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("%s: server %d, expected = %d, actual = %d", t.Name(), i, expected, resp.StatusCode)
+		}
+		if i == 1 && string(body) != "eu-west" {
+			t.Fatalf("%s: flags not independent, actual = %s", t.Name(), body)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package nicohttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	defaultReadTimeout time.Duration = 60 * time.Second
+	defaultReadHeaderTimeout time.Duration = 10 * time.Second
+	defaultWriteTimeout time.Duration = 60 * time.Second
+	defaultIdleTimeout time.Duration = 60 * time.Second
+)
+
+var errBodyTooLarge = errors.New("http: request body too large")
+
+
+// WithReadTimeout - time allowed to read a whole request, body included. 0 means no limit.
+// Default is 60s, -readTimeout overrides
+func (b *NicoBuilder) WithReadTimeout(d time.Duration) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.setDuration(ReadTimeoutKey, d)
+	return b
+}
+
+
+// WithReadHeaderTimeout - time allowed to read the request headers, the slowloris protection.
+// Default is 10s, -readHeaderTimeout overrides
+func (b *NicoBuilder) WithReadHeaderTimeout(d time.Duration) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.setDuration(ReadHeaderTimeoutKey, d)
+	return b
+}
+
+
+// WithWriteTimeout - time allowed from the end of the request headers to the end of the
+// response. 0 means no limit, e.g. for long streaming responses. Default is 60s, -writeTimeout
+// overrides
+func (b *NicoBuilder) WithWriteTimeout(d time.Duration) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.setDuration(WriteTimeoutKey, d)
+	return b
+}
+
+
+// WithIdleTimeout - time a keep-alive connection waits for the next request. Default is 60s,
+// -idleTimeout overrides
+func (b *NicoBuilder) WithIdleTimeout(d time.Duration) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.setDuration(IdleTimeoutKey, d)
+	return b
+}
+
+
+// WithMaxHeaderBytes - maximum size of the request headers. Default is 1MB, -maxHeaderBytes
+// overrides
+func (b *NicoBuilder) WithMaxHeaderBytes(n int) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.props[MaxHeaderBytesKey] = n
+	return b
+}
+
+
+// WithMaxBodyBytes - maximum size of request bodies, larger requests are answered with a 413.
+// Default is 0 (no limit), -maxBodyBytes overrides
+func (b *NicoBuilder) WithMaxBodyBytes(n int64) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.props[MaxBodyBytesKey] = n
+	return b
+}
+
+
+// WithKeepAlives - turn HTTP keep-alives on (default) or off, -keepAlives overrides
+func (b *NicoBuilder) WithKeepAlives(enabled bool) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.props[KeepAlivesKey] = enabled
+	return b
+}
+
+
+// WithH2C - serve HTTP/2 without TLS (h2c) next to HTTP/1.1, e.g. behind a proxy or service mesh
+// that speaks HTTP/2 to the service. -h2c overrides
+func (b *NicoBuilder) WithH2C() (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.props[H2CKey] = true
+	return b
+}
+
+
+// configureHTTPServer - applies the timeouts, limits and protocol settings of the builder to s,
+// flags overriding builder options
+func configureHTTPServer(b *NicoBuilder, s *http.Server) error {
+	s.ReadTimeout = b.durationProp(ReadTimeoutKey, "readTimeout")
+	s.ReadHeaderTimeout = b.durationProp(ReadHeaderTimeoutKey, "readHeaderTimeout")
+	s.WriteTimeout = b.durationProp(WriteTimeoutKey, "writeTimeout")
+	s.IdleTimeout = b.durationProp(IdleTimeoutKey, "idleTimeout")
+	if b.flagset["maxHeaderBytes"] {
+		b.props[MaxHeaderBytesKey] = b.intFlag("maxHeaderBytes")
+	}
+	s.MaxHeaderBytes = (b.props[MaxHeaderBytesKey]).(int)
+	if b.flagset["maxBodyBytes"] {
+		b.props[MaxBodyBytesKey] = b.int64Flag("maxBodyBytes")
+	}
+	b.server.maxBodyBytes = (b.props[MaxBodyBytesKey]).(int64)
+	if b.flagset["keepAlives"] {
+		b.props[KeepAlivesKey] = b.boolFlag("keepAlives")
+	}
+	s.SetKeepAlivesEnabled((b.props[KeepAlivesKey]).(bool))
+	if b.flagset["h2c"] {
+		b.props[H2CKey] = b.boolFlag("h2c")
+	}
+	if (b.props[H2CKey]).(bool) {
+		h2s := &http2.Server{IdleTimeout: s.IdleTimeout}
+		/* ConfigureServer has Shutdown drain the h2c connections too, the TLS settings stay for
+		   configureTLS */
+		tlsConfig, tlsNextProto := s.TLSConfig, s.TLSNextProto
+		if err := http2.ConfigureServer(s, h2s); err != nil {
+			return fmt.Errorf("h2c: %w", err)
+		}
+		s.TLSConfig, s.TLSNextProto = tlsConfig, tlsNextProto
+		s.Handler = h2c.NewHandler(s.Handler, h2s)
+	}
+	return nil
+}
+
+
+// durationProp - the duration of a prop set with setDuration, the flag overriding it when set
+func (b *NicoBuilder) durationProp(key, flagName string) time.Duration {
+	if b.flagset[flagName] {
+		b.setDuration(key, b.durationFlag(flagName))
+	}
+	return b.duration(key)
+}
+
+
+// bodyLimitMediator - answers requests whose body exceeds the maximum body size with a 413,
+// whether announced by Content-Length or found while the handler reads the body
+func (h *NicoServer) bodyLimitMediator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		max := h.maxBodyBytes
+		if max <= 0 || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > max {
+			WriteProblemf(w, r, http.StatusRequestEntityTooLarge, "request body exceeds %d bytes", max)
+			return
+		}
+		body := &limitedBody{ReadCloser: r.Body, remaining: max}
+		r.Body = body
+		bw := &bodyLimitWriter{ResponseWriter: w, body: body, r: r, max: max}
+		next.ServeHTTP(bw, r)
+		if !bw.wroteHeader && body.tooLarge() {
+			bw.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	})
+}
+
+
+// limitedBody - fails reads past the limit, remembering it did
+type limitedBody struct {
+	io.ReadCloser
+	mu sync.Mutex
+	remaining int64
+	exceeded bool
+}
+
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.exceeded {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > l.remaining + 1 {
+		p = p[:l.remaining + 1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	if int64(n) > l.remaining {
+		l.exceeded = true
+		n = int(l.remaining)
+		err = errBodyTooLarge
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+
+func (l *limitedBody) tooLarge() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.exceeded
+}
+
+
+// bodyLimitWriter - replaces the handler's response with the 413 if the body turned out too
+// large before the response started
+type bodyLimitWriter struct {
+	http.ResponseWriter
+	body *limitedBody
+	r *http.Request
+	max int64
+	wroteHeader bool
+	replaced bool
+}
+
+
+func (w *bodyLimitWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.body.tooLarge() {
+		w.replaced = true
+		WriteProblemf(w.ResponseWriter, w.r, http.StatusRequestEntityTooLarge, "request body exceeds %d bytes", w.max)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+
+func (w *bodyLimitWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+
+// Flush - lets streaming handlers flush through the body limit
+func (w *bodyLimitWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+
+// Unwrap - the wrapped writer, for http.ResponseController
+func (w *bodyLimitWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
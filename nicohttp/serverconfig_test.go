@@ -0,0 +1,149 @@
+package nicohttp
+
+import (
+	"crypto/tls"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+
+func TestServerSettings(t *testing.T) {
+	fs := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	b := GetBuilder().WithDefaults().WithNoMemoryLogger().WithBaseFlags().WithFlagSet(fs).
+		WithReadTimeout(1500 * time.Millisecond).WithWriteTimeout(0).WithIdleTimeout(2 * time.Minute).WithMaxHeaderBytes(8192).WithKeepAlives(false)
+	initBaseFlags(fs)
+	fs.Parse([]string{"-serviceName", t.Name(), "-readHeaderTimeout", "5s", "-maxBodyBytes", "16"})
+	srv, _ := b.Create(t.Name(), 0)
+
+	s := srv.server
+	if s.ReadTimeout != 1500*time.Millisecond || s.ReadHeaderTimeout != 5*time.Second || s.WriteTimeout != 0 ||
+		s.IdleTimeout != 2*time.Minute || s.MaxHeaderBytes != 8192 || srv.maxBodyBytes != 16 {
+		t.Fatalf("%s: unexpected settings %+v", t.Name(), s)
+	}
+	if b.Props()[ReadHeaderTimeoutKey] != time.Duration(5) || b.Props()[ReadTimeoutKey] != time.Duration(1) || b.Props()[KeepAlivesKey] != false {
+		t.Fatalf("%s: unexpected props %v", t.Name(), b.Props())
+	}
+}
+
+
+func TestBodyLimit(t *testing.T) {
+	srv, _ := GetBuilder().WithDefaults().WithNoMemoryLogger().WithMaxBodyBytes(16).Create(t.Name(), 0)
+	srv.Mux().HandleFunc("/regions", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write(body)
+	})
+
+	tests := []struct {
+		body string
+		chunked bool
+		status int
+	}{
+		{"us-east", false, http.StatusOK},
+		{strings.Repeat("x", 16), true, http.StatusOK},
+		{strings.Repeat("x", 17), false, http.StatusRequestEntityTooLarge},
+		{strings.Repeat("x", 64), true, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/regions", strings.NewReader(tt.body))
+		if tt.chunked {
+			req.ContentLength = -1
+		}
+		rec := httptest.NewRecorder()
+		srv.server.Handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Fatalf("%s: %d bytes, expected = %d, actual = %d", t.Name(), len(tt.body), tt.status, rec.Code)
+		}
+		if tt.status == http.StatusRequestEntityTooLarge && rec.Header().Get("Content-Type") != ProblemJSON {
+			t.Fatalf("%s: expected a problem, actual = %s", t.Name(), rec.Body.String())
+		}
+	}
+}
+
+
+func TestBodyLimitStreaming(t *testing.T) {
+	p := getLoggerPort()
+	srv, _ := GetBuilder().WithDefaults().WithNoMemoryLogger().WithMaxBodyBytes(16).Create(t.Name(), p)
+	controlled := make(chan error, 1)
+	srv.Mux().HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		/* reaches the connection through every writer of the pipeline */
+		controlled <- http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Minute))
+		w.Write([]byte("data: 2\n\n"))
+	})
+	go srv.Start()
+	<-srv.Ready()
+	defer srv.Stop()
+
+	resp, err := http.Get(getTarget(p, "/events"))
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	defer resp.Body.Close()
+	first := make([]byte, len("data: 1\n\n"))
+	if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "data: 1\n\n" {
+		t.Fatalf("%s: first event not flushed: %q, %v", t.Name(), first, err)
+	}
+	if err := <-controlled; err != nil {
+		t.Fatalf("%s: response controller: %s", t.Name(), err)
+	}
+	rest, _ := io.ReadAll(resp.Body)
+	if string(rest) != "data: 2\n\n" {
+		t.Fatalf("%s: actual = %q", t.Name(), rest)
+	}
+}
+
+
+func TestH2C(t *testing.T) {
+	p := getLoggerPort()
+	srv, _ := GetBuilder().WithDefaults().WithNoMemoryLogger().WithH2C().Create(t.Name(), p)
+	srv.Mux().HandleFunc("/proto", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	go srv.Start()
+	<-srv.Ready()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err := client.Get(getTarget(p, "/proto"))
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	proto, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(proto) != "HTTP/2.0" {
+		t.Fatalf("%s: expected HTTP/2.0, actual = %s", t.Name(), proto)
+	}
+
+	/* the shutdown closes the idle h2c connection instead of leaving it serving, once the
+	   connection has read the GOAWAY it was sent */
+	if err := srv.Stop(); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		resp, err := client.Get(getTarget(p, "/proto"))
+		if err != nil {
+			break
+		}
+		resp.Body.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: h2c connection still served after the shutdown", t.Name())
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package nicohttp
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// WithShutdownTimeout - time in flight requests have to complete on shutdown, and the time
+// OnShutdown hooks and the final log flush have after that. Default is 60s, -shutdownTimeout overrides
+func (b *NicoBuilder) WithShutdownTimeout(d time.Duration) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.setDuration(ShutdownWaitKey, d)
+	return b
+}
+
+
+// WithPreStopDelay - on shutdown, keep serving for d after readiness starts failing so load
+// balancers stop routing to the service before it stops accepting connections. Default is 0,
+// -preStopDelay overrides
+func (b *NicoBuilder) WithPreStopDelay(d time.Duration) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.setDuration(PreStopDelayKey, d)
+	return b
+}
+
+
+// WithShutdownSignals - signals starting a graceful shutdown. Default, and used when sigs is
+// empty, is SIGINT and SIGTERM
+func (b *NicoBuilder) WithShutdownSignals(sigs ...os.Signal) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	if len(sigs) == 0 {
+		/* signal.Notify would relay every signal, SIGCHLD and SIGURG included */
+		sigs = defaultShutdownSignals
+	}
+	b.server.signals = sigs
+	b.props[ShutdownSignalsKey] = signalNames(sigs)
+	return b
+}
+
+
+func signalNames(sigs []os.Signal) string {
+	names := make([]string, 0, len(sigs))
+	for _, s := range sigs {
+		names = append(names, s.String())
+	}
+	return strings.Join(names, ",")
+}
+
+
+// gracefulStop - drains once, however many of Run, Stop and /shutdown ask for it, returning
+// whether the drain completed
+func (h *NicoServer) gracefulStop() bool {
+	h.stopOnce.Do(func() {
+		close(h.stopping)
+		h.stopComplete = h.drain()
+	})
+	return h.stopComplete
+}
+
+
+// drain - graceful shutdown: fail readiness, wait the pre-stop delay, stop accepting connections
+// and wait for in flight requests, run the OnShutdown hooks, then flush traces and logs. Returns
+// false if any step did not complete in time or failed
+func (h *NicoServer) drain() bool {
+	complete := true
+	atomic.StoreInt32(&h.draining, 1)
+	unregisterUpgradeServer(h)
+	if h.preStopDelay > 0 {
+		h.logger.Printf("Service %s draining, readiness failing for %s before closing listeners\n", h.svcName, h.preStopDelay)
+		time.Sleep(h.preStopDelay)
+	}
+
+	h.server.SetKeepAlivesEnabled(false)
+	ctx, cancel := context.WithTimeout(context.Background(), h.shutdownWait)
+	defer cancel()
+	if err := h.server.Shutdown(ctx); err != nil {
+		h.logger.Printf("Service %s: in flight requests did not complete within %s: %s\n", h.svcName, h.shutdownWait, err)
+		h.server.Close()
+		complete = false
+	}
+
+	/* the drain may have used up its budget, cleanup gets its own */
+	cleanupCtx, cleanupCancel := context.WithTimeout(context.Background(), h.shutdownWait)
+	defer cleanupCancel()
+	if err := runHooks(cleanupCtx, h, shutdownPhase); err != nil {
+		complete = false
+	}
+	if err := h.tracer.shutdown(cleanupCtx); err != nil {
+		h.logger.Printf("Service %s: trace export on shutdown failed: %s\n", h.svcName, err)
+		complete = false
+	}
+	/* in flight requests still log, so the memory logger is stopped (and flushed) last */
+	if (!h.builder.disabledMemoryLogs) {
+		if err := stopMemoryLogger(cleanupCtx, h); err != nil {
+			complete = false
+		}
+	}
+	return complete
+}
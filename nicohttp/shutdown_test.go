@@ -0,0 +1,80 @@
+package nicohttp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+
+func serveForDrain(t *testing.T, b *NicoBuilder, h http.Handler) (*NicoServer, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	b.WithNoMemoryLogger()
+	initBuiltServer(t.Name(), 0, b, &http.Server{Handler: h})
+	go b.server.server.Serve(l)
+	return b.server, "http://" + l.Addr().String()
+}
+
+
+func TestDrainRunsHooksInReverse(t *testing.T) {
+	var order []string
+	hook := func(name string, err error) LifecycleHook {
+		return func(ctx context.Context) error {
+			order = append(order, name)
+			return err
+		}
+	}
+	b := GetBuilder().WithDefaults().WithShutdownTimeout(time.Second).
+		OnShutdown("db", hook("db", nil)).
+		OnShutdown("cache", hook("cache", nil))
+	srv, _ := serveForDrain(t, b, http.NotFoundHandler())
+
+	if !srv.drain() {
+		t.Fatalf("%s: expected a complete drain", t.Name())
+	}
+	if !reflect.DeepEqual(order, []string{"cache", "db"}) {
+		t.Fatalf("%s: expected hooks in reverse order, actual = %v", t.Name(), order)
+	}
+	if atomic.LoadInt32(&srv.draining) != 1 || notReadyReason(srv) != "draining" {
+		t.Fatalf("%s: readiness must fail once draining", t.Name())
+	}
+}
+
+
+func TestDrainIncomplete(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	b := GetBuilder().WithDefaults().WithShutdownTimeout(time.Second).
+		OnShutdown("db", func(ctx context.Context) error { return errors.New("close failed") })
+	srv, url := serveForDrain(t, b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	srv.shutdownWait = 50 * time.Millisecond
+	go http.Get(url)
+	time.Sleep(20 * time.Millisecond)
+
+	if srv.drain() {
+		t.Fatalf("%s: a stuck request and a failing hook must fail the drain", t.Name())
+	}
+}
+
+
+func TestShutdownDurations(t *testing.T) {
+	b := GetBuilder().WithDefaults().WithNoMemoryLogger().WithShutdownTimeout(1500 * time.Millisecond).
+		WithPreStopDelay(500 * time.Millisecond)
+	initBuiltServer(t.Name(), 0, b, &http.Server{})
+	if b.server.shutdownWait != 1500 * time.Millisecond || b.server.preStopDelay != 500 * time.Millisecond {
+		t.Fatalf("%s: shutdownWait %s, preStopDelay %s", t.Name(), b.server.shutdownWait, b.server.preStopDelay)
+	}
+	if b.Props()[ShutdownWaitKey] != time.Duration(1) {
+		t.Fatalf("%s: %s is %v", t.Name(), ShutdownWaitKey, b.Props()[ShutdownWaitKey])
+	}
+}
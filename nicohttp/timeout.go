@@ -0,0 +1,256 @@
+package nicohttp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultTimeoutStatus int = http.StatusServiceUnavailable
+	defaultTimeoutDetail string = "handler timed out"
+)
+
+
+// WithTimeoutHandler - require custom HTTPServer to timeout request if upstream
+// handlers not responsive. Handlers get the deadline through r.Context(). Default is 300s,
+// -handlerTimeout overrides
+func (b *NicoBuilder) WithTimeoutHandler(d time.Duration) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.setStage(TimeoutStage, b.server.timeoutMediator)
+	b.setDuration(HandlerTimeoutKey, d)
+	return b
+}
+
+
+// WithTimeoutResponse - status (503 by default, or e.g. 504) and problem detail of the response to
+// a request whose handler timed out
+func (b *NicoBuilder) WithTimeoutResponse(status int, detail string) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.server.timeoutStatus = status
+	b.server.timeoutDetail = detail
+	b.props[TimeoutResponseKey] = status
+	return b
+}
+
+
+// RouteTimeout - overrides the handler timeout for the route, 0 disables it (e.g. for streaming)
+func (h *NicoServer) RouteTimeout(route *mux.Route, d time.Duration) (*mux.Route) {
+	defer h.timeoutsLock.Unlock()
+	h.timeoutsLock.Lock()
+	if h.routeTimeouts == nil {
+		h.routeTimeouts = make(map[*mux.Route]time.Duration)
+	}
+	h.routeTimeouts[route] = d
+	return route
+}
+
+
+func (h *NicoServer) routeTimeout(r *http.Request) time.Duration {
+	var match mux.RouteMatch
+	if h.httpRouter == nil || !h.httpRouter.Match(r, &match) || match.Route == nil {
+		return h.handlerTimeout
+	}
+	defer h.timeoutsLock.RUnlock()
+	h.timeoutsLock.RLock()
+	if d, ok := h.routeTimeouts[match.Route]; ok {
+		return d
+	}
+	return h.handlerTimeout
+}
+
+
+// timeoutMediator - runs the handler with a deadline on its context, passing its writes through.
+// If the deadline passes first, the timeout response is sent, or the connection aborted if the
+// response had started, the handler's writes fail with http.ErrHandlerTimeout, and the route is
+// logged and counted
+func (h *NicoServer) timeoutMediator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := h.routeTimeout(r)
+		if d <= 0 || upgradeRequest(r) {
+			/* a websocket or other upgraded connection outlives any handler timeout */
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{w: w, header: make(http.Header)}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					tw.mu.Lock()
+					defer tw.mu.Unlock()
+					if !tw.timedOut {
+						panicked <- p
+						return
+					}
+					/* nobody serves the request any more, only the log records the panic */
+					h.logger.Printf("level=error requestID=%s panic after the handler timed out serving %s %s: %v\n%s",
+						RequestID(ctx), r.Method, r.RequestURI, p, debug.Stack())
+				}
+			}()
+			next.ServeHTTP(tw, r)
+			close(done)
+		}()
+		select {
+			case p := <-panicked:
+				panic(p)
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				if !tw.wroteHeader {
+					copyHeader(w.Header(), tw.header)
+				}
+			case <-ctx.Done():
+				tw.mu.Lock()
+				tw.timedOut = true
+				select {
+					case p := <-panicked:
+						tw.mu.Unlock()
+						panic(p)
+					default:
+				}
+				defer tw.mu.Unlock()
+				if ctx.Err() != context.DeadlineExceeded || tw.hijacked {
+					return /* client gone, or the connection is the handler's */
+				}
+				name := routeName(h.httpRouter, r)
+				if name == "" {
+					name = "unmatched"
+				}
+				h.serverMetrics.timeouts.Inc(name, methodLabel(r.Method))
+				h.logger.Printf("level=warn requestID=%s handler timed out after %s on route %s (%s %s)\n",
+					RequestID(ctx), d, name, r.Method, r.RequestURI)
+				if tw.wroteHeader {
+					/* the client must not take the partial response for a complete one */
+					panic(http.ErrAbortHandler)
+				}
+				WriteProblem(w, r, h.timeoutStatus, h.timeoutDetail)
+		}
+	})
+}
+
+
+// timeoutWriter - passes the handler's writes through until the deadline, failing them after
+type timeoutWriter struct {
+	w http.ResponseWriter
+	header http.Header
+	mu sync.Mutex
+	wroteHeader bool
+	timedOut bool
+	hijacked bool
+}
+
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.writeHeader(http.StatusOK)
+	}
+	return tw.w.Write(p)
+}
+
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	if code < 100 || code > 999 {
+		panic(fmt.Sprintf("invalid WriteHeader code %v", code))
+	}
+	tw.writeHeader(code)
+}
+
+
+// Flush - lets streaming handlers flush, until the deadline
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	if !tw.wroteHeader {
+		tw.writeHeader(http.StatusOK)
+	}
+	if f, ok := tw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+
+// Unwrap - the wrapped writer, for http.ResponseController
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.w
+}
+
+
+// Hijack - hands the connection to the handler, until the deadline. The timeout response is not
+// sent on a hijacked connection
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	conn, rw, err := http.NewResponseController(tw.w).Hijack()
+	if err == nil {
+		tw.hijacked = true
+	}
+	return conn, rw, err
+}
+
+
+// upgradeRequest - true for a request asking to switch protocols, e.g. to a websocket
+func upgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+
+/* with tw.mu held */
+func (tw *timeoutWriter) writeHeader(code int) {
+	copyHeader(tw.w.Header(), tw.header)
+	tw.w.WriteHeader(code)
+	tw.wroteHeader = true
+}
+
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		dst[k] = vv
+	}
+}
@@ -0,0 +1,226 @@
+package nicohttp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+
+func TestRouteTimeouts(t *testing.T) {
+	srv, _ := GetBuilder().WithDefaults().WithNoMemoryLogger().
+		WithTimeoutHandler(time.Minute).WithTimeoutResponse(http.StatusGatewayTimeout, "upstream too slow").
+		Create(t.Name(), 0)
+	aborted := make(chan error, 1)
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+			case <-r.Context().Done():
+				aborted <- r.Context().Err()
+			case <-time.After(time.Second):
+				w.Write([]byte("late"))
+		}
+	}
+	srv.RouteTimeout(srv.Mux().HandleFunc("/report", slow), 20*time.Millisecond).Name("report")
+	srv.RouteTimeout(srv.Mux().HandleFunc("/export", slow), 0)
+	srv.Mux().HandleFunc("/regions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("[]"))
+	})
+
+	rec := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/report", nil))
+	var p Problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil || rec.Code != http.StatusGatewayTimeout || p.Detail != "upstream too slow" {
+		t.Fatalf("%s: expected the timeout response, actual = %d %s", t.Name(), rec.Code, rec.Body.String())
+	}
+	select {
+		case err := <-aborted:
+			if err == nil {
+				t.Fatalf("%s: expected the deadline on the handler context", t.Name())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: handler context not cancelled", t.Name())
+	}
+	rec = httptest.NewRecorder()
+	srv.getMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `nicohttp_http_timeouts_total{route="report",method="GET"} 1`) {
+		t.Fatalf("%s: timeout not counted", t.Name())
+	}
+
+	rec = httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/export", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "late" {
+		t.Fatalf("%s: route without timeout, actual = %d %s", t.Name(), rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/regions", nil))
+	if rec.Code != http.StatusCreated || rec.Body.String() != "[]" || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("%s: buffered response not passed through, actual = %d %s", t.Name(), rec.Code, rec.Body.String())
+	}
+}
+
+
+func TestTimeoutStreaming(t *testing.T) {
+	srv, _ := GetBuilder().WithDefaults().WithNoMemoryLogger().WithTimeoutHandler(time.Minute).Create(t.Name(), 0)
+	flushed := make(chan struct{})
+	srv.Mux().HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		close(flushed)
+		w.Write([]byte("data: 2\n\n"))
+	})
+
+	rec := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events", nil))
+	<-flushed
+	if !rec.Flushed || rec.Body.String() != "data: 1\n\ndata: 2\n\n" || rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("%s: flushed %t, actual = %s", t.Name(), rec.Flushed, rec.Body.String())
+	}
+}
+
+
+func TestTimeoutAfterResponseStarted(t *testing.T) {
+	srv, _ := GetBuilder().WithDefaults().WithNoMemoryLogger().Create(t.Name(), 0)
+	late := make(chan error, 1)
+	srv.RouteTimeout(srv.Mux().HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		<-r.Context().Done()
+		_, err := w.Write([]byte("late"))
+		late <- err
+	}), 20*time.Millisecond)
+
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Fatalf("%s: expected the connection aborted, actual = %v", t.Name(), p)
+		}
+		if err := <-late; err != http.ErrHandlerTimeout {
+			t.Fatalf("%s: expected late writes to fail, actual = %v", t.Name(), err)
+		}
+	}()
+	srv.server.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/export", nil))
+}
+
+
+func TestTimeoutLatePanic(t *testing.T) {
+	srv, _ := GetBuilder().WithDefaults().WithNoMemoryLogger().Create(t.Name(), 0)
+	logs := &syncBuffer{}
+	srv.logger.SetOutput(logs)
+	srv.RouteTimeout(srv.Mux().HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		time.Sleep(10 * time.Millisecond)
+		panic("late failure")
+	}), 20*time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/report", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("%s: expected the timeout response, actual = %d", t.Name(), rec.Code)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "panic after the handler timed out serving GET /report: late failure") {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: late panic not logged: %s", t.Name(), logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+
+func TestHandlerTimeoutDuration(t *testing.T) {
+	b := GetBuilder().WithDefaults().WithNoMemoryLogger().WithTimeoutHandler(500 * time.Millisecond)
+	initBuiltServer(t.Name(), 0, b, &http.Server{})
+	if b.server.handlerTimeout != 500 * time.Millisecond {
+		t.Fatalf("%s: handler timeout %s", t.Name(), b.server.handlerTimeout)
+	}
+}
+
+
+/* log output written by handler goroutines */
+type syncBuffer struct {
+	mu sync.Mutex
+	buf bytes.Buffer
+}
+
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+
+func TestTimeoutHijack(t *testing.T) {
+	p := getLoggerPort()
+	srv, _ := GetBuilder().WithDefaults().WithNoMemoryLogger().Create(t.Name(), p)
+	deadlines := make(chan bool, 2)
+	hijack := func(w http.ResponseWriter, r *http.Request) {
+		_, ok := r.Context().Deadline()
+		deadlines <- ok
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nhijacked")
+		rw.Flush()
+	}
+	srv.Mux().HandleFunc("/ws", hijack)
+	srv.Mux().HandleFunc("/tunnel", func(w http.ResponseWriter, r *http.Request) {
+		/* hijackers asserting the interface get the connection too */
+		if _, ok := w.(http.Hijacker); !ok {
+			http.Error(w, "not a hijacker", http.StatusInternalServerError)
+			return
+		}
+		hijack(w, r)
+	})
+	go srv.Start()
+	<-srv.Ready()
+	defer srv.Stop()
+
+	for path, upgrade := range map[string]bool{"/ws": true, "/tunnel": false} {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", p))
+		if err != nil {
+			t.Fatalf("%s: %s", t.Name(), err)
+		}
+		req := "GET " + path + " HTTP/1.1\r\nHost: localhost\r\n"
+		if upgrade {
+			req += "Connection: keep-alive, Upgrade\r\nUpgrade: echo\r\n"
+		}
+		conn.Write([]byte(req + "\r\n"))
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("%s: %s: %s", t.Name(), path, err)
+		}
+		/* the switched protocol follows the 101 */
+		body, _ := io.ReadAll(br)
+		conn.Close()
+		if resp.StatusCode != http.StatusSwitchingProtocols || string(body) != "hijacked" {
+			t.Fatalf("%s: %s: status %d, body %s", t.Name(), path, resp.StatusCode, body)
+		}
+		/* an upgrade is exempt from the handler timeout, other requests keep it */
+		if deadline := <-deadlines; deadline == upgrade {
+			t.Fatalf("%s: %s: deadline %t", t.Name(), path, deadline)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package nicohttp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTLSMinVersion uint16 = tls.VersionTLS12
+)
+
+// certReloadInterval - how often, at most, the certificate files are checked for changes
+var certReloadInterval = 10 * time.Second
+
+/* TLS 1.0 and 1.1 are deprecated (RFC 8996) and not accepted */
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+
+// WithTLS - serve HTTPS with the PEM certificate and key files. The files are reloaded when they
+// change, so renewed certificates are served without a restart. -tlsCert and -tlsKey override
+func (b *NicoBuilder) WithTLS(certFile, keyFile string) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.props[TLSCertKey] = certFile
+	b.props[TLSKeyKey] = keyFile
+	return b
+}
+
+
+// WithTLSMinVersion - minimum TLS version accepted, tls.VersionTLS12 or tls.VersionTLS13. Default
+// is TLS 1.2, -tlsMinVersion overrides
+func (b *NicoBuilder) WithTLSMinVersion(version uint16) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.props[TLSMinVersionKey] = tlsVersionName(version)
+	return b
+}
+
+
+// WithTLSCipherSuites - TLS 1.2 cipher suites accepted, by name (see tls.CipherSuites()).
+// TLS 1.3 suites are not configurable. Default is the Go default policy, -tlsCipherSuites
+// overrides
+func (b *NicoBuilder) WithTLSCipherSuites(names ...string) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.props[TLSCipherSuitesKey] = strings.Join(names, ",")
+	return b
+}
+
+
+// WithClientCA - mutual TLS: verify client certificates against the PEM CA bundle. If required,
+// clients without a valid certificate are refused, otherwise certificates are verified if given.
+// Combine with WithAuthNMediator(MTLS, "") to authenticate requests by the client certificate
+// subject. -tlsClientCA and -tlsClientAuth override
+func (b *NicoBuilder) WithClientCA(caFile string, required bool) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.props[TLSClientCAKey] = caFile
+	b.props[TLSClientAuthKey] = clientAuthName(required)
+	return b
+}
+
+
+// configureTLS - builds the TLS configuration of s from the builder options and flags, s serves
+// plain HTTP if no certificate is configured
+func configureTLS(b *NicoBuilder, s *http.Server) error {
+	for key, name := range map[string]string{TLSCertKey: "tlsCert", TLSKeyKey: "tlsKey",
+		TLSMinVersionKey: "tlsMinVersion", TLSCipherSuitesKey: "tlsCipherSuites",
+		TLSClientCAKey: "tlsClientCA", TLSClientAuthKey: "tlsClientAuth"} {
+		if b.flagset[name] {
+			b.props[key] = b.stringFlag(name)
+		}
+	}
+	certFile := (b.props[TLSCertKey]).(string)
+	if certFile == "None" {
+		return nil
+	}
+	reloader, err := newCertReloader(b.server, certFile, (b.props[TLSKeyKey]).(string))
+	if err != nil {
+		return err
+	}
+	cfg := &tls.Config{GetCertificate: reloader.getCertificate}
+
+	minVersion := (b.props[TLSMinVersionKey]).(string)
+	v, ok := tlsVersions[minVersion]
+	if !ok {
+		return fmt.Errorf("unsupported TLS version %s", minVersion)
+	}
+	cfg.MinVersion = v
+
+	if suites := (b.props[TLSCipherSuitesKey]).(string); suites != "Default" {
+		ids, err := cipherSuiteIDs(suites)
+		if err != nil {
+			return err
+		}
+		cfg.CipherSuites = ids
+	}
+
+	if caFile := (b.props[TLSClientCAKey]).(string); caFile != "None" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no CA certificate found in %s", caFile)
+		}
+		cfg.ClientCAs = pool
+		switch (b.props[TLSClientAuthKey]).(string) {
+			case clientAuthName(true), "None":
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			case clientAuthName(false):
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			default:
+				return fmt.Errorf("unsupported client auth %s, require or optional", b.props[TLSClientAuthKey])
+		}
+	}
+	s.TLSConfig = cfg
+	return nil
+}
+
+
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+
+func clientAuthName(required bool) string {
+	if required {
+		return "require"
+	}
+	return "optional"
+}
+
+
+func cipherSuiteIDs(names string) ([]uint16, error) {
+	byName := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		byName[cs.Name] = cs.ID
+	}
+	ids := make([]uint16, 0)
+	for _, name := range strings.Split(names, ",") {
+		id, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported or insecure cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+
+// certReloader - serves the certificate of the cert and key files, reloading them on handshakes
+// once they changed. A failed reload keeps the previous certificate
+type certReloader struct {
+	server *NicoServer
+	certFile string
+	keyFile string
+	mu sync.Mutex
+	cert *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+
+func newCertReloader(server *NicoServer, certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{server: server, certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+
+func (cr *certReloader) load() error {
+	modTime, err := cr.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+
+// lastModified - the latest modification time of the cert and key files
+func (cr *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+
+func (cr *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if time.Since(cr.checked) < certReloadInterval {
+		return cr.cert, nil
+	}
+	cr.checked = time.Now()
+	if modTime, err := cr.lastModified(); err != nil || modTime.Equal(cr.modTime) {
+		return cr.cert, nil
+	}
+	if err := cr.load(); err != nil {
+		cr.server.logger.Printf("level=error reloading certificate %s failed, serving the previous one: %s\n", cr.certFile, err)
+		return cr.cert, nil
+	}
+	cr.server.logger.Printf("Reloaded certificate %s\n", cr.certFile)
+	return cr.cert, nil
+}
+
+
+// mtlsMediator - authenticates the request by the subject of its verified client certificate
+func mtlsMediator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			WriteProblem(w, r, http.StatusForbidden, "verified client certificate required")
+			return
+		}
+		user := r.TLS.VerifiedChains[0][0].Subject.String()
+		next.ServeHTTP(w, authenticated(r, user))
+	})
+}
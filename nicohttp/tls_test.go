@@ -0,0 +1,167 @@
+package nicohttp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+
+type testCert struct {
+	cert *x509.Certificate
+	key *ecdsa.PrivateKey
+	tls tls.Certificate
+}
+
+
+// newTestCert - a certificate for cn signed by ca, self-signed if ca is nil
+func newTestCert(t *testing.T, cn string, serial int64, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject: pkix.Name{CommonName: cn, Organization: []string{"Nico"}},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	parent, signer := tpl, key
+	if ca == nil {
+		tpl.IsCA, tpl.BasicConstraintsValid = true, true
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, tls: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalECPrivateKey(c.key)
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	ca := newTestCert(t, "Nico CA", 1, nil)
+	ca.write(t, caFile, filepath.Join(dir, "ca.key"))
+	newTestCert(t, "server", 2, ca).write(t, certFile, keyFile)
+	client := newTestCert(t, "billing", 3, ca)
+
+	defer func(d time.Duration) { certReloadInterval = d }(certReloadInterval)
+	certReloadInterval = 0
+	p := getLoggerPort()
+	srv, err := GetBuilder().WithDefaults().WithNoMemoryLogger().
+		WithTLS(certFile, keyFile).WithTLSMinVersion(tls.VersionTLS13).WithClientCA(caFile, true).
+		WithAuthNMediator(MTLS, "").Create(t.Name(), p)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	srv.Mux().HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(AuthenticatedUser(r.Context())))
+	})
+	srv.Mux().HandleFunc("/logged", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %v", authenticatedUser(r), r.Header.Values("X-AUTH-USER"))
+	})
+	go srv.Start()
+	<-srv.Ready()
+	defer srv.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	url := fmt.Sprintf("https://127.0.0.1:%d/whoami", p)
+	get := func(certs []tls.Certificate, maxVersion uint16) (*http.Response, error) {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots,
+			Certificates: certs, MaxVersion: maxVersion}}}
+		return c.Get(url)
+	}
+
+	resp, err := get([]tls.Certificate{client.tls}, 0)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	user, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(user) != "CN=billing,O=Nico" || resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 2 {
+		t.Fatalf("%s: unexpected user %s", t.Name(), user)
+	}
+	/* a user header sent by the client does not override the certificate subject */
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("https://127.0.0.1:%d/logged", p), nil)
+	req.Header.Set("X-AUTH-USER", "admin")
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots,
+		Certificates: []tls.Certificate{client.tls}}}}
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	logged, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(logged) != "CN=billing,O=Nico [CN=billing,O=Nico]" {
+		t.Fatalf("%s: spoofed user header, logged as %s", t.Name(), logged)
+	}
+	if resp, err := get(nil, 0); err == nil {
+		resp.Body.Close()
+		t.Fatalf("%s: expected a client certificate to be required", t.Name())
+	}
+	if _, err := get([]tls.Certificate{client.tls}, tls.VersionTLS12); err == nil {
+		t.Fatalf("%s: expected TLS 1.2 to be refused", t.Name())
+	}
+
+	time.Sleep(10 * time.Millisecond) /* distinct modification time */
+	newTestCert(t, "server", 4, ca).write(t, certFile, keyFile)
+	resp, err = get([]tls.Certificate{client.tls}, 0)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	resp.Body.Close()
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 4 {
+		t.Fatalf("%s: certificate not reloaded, serial = %d", t.Name(), serial)
+	}
+}
+
+
+func TestTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	newTestCert(t, "server", 1, nil).write(t, certFile, keyFile)
+	tests := []*NicoBuilder{
+		GetBuilder().WithDefaults().WithTLS(filepath.Join(dir, "missing.crt"), keyFile),
+		GetBuilder().WithDefaults().WithTLS(certFile, keyFile).WithTLSCipherSuites("TLS_RSA_WITH_RC4_128_SHA"),
+		GetBuilder().WithDefaults().WithTLS(certFile, keyFile).WithClientCA(keyFile, true),
+		GetBuilder().WithDefaults().WithTLS(certFile, keyFile).WithTLSMinVersion(tls.VersionTLS10),
+		GetBuilder().WithDefaults().WithTLS(certFile, keyFile).WithTLSMinVersion(tls.VersionTLS11),
+	}
+	for i, b := range tests {
+		if _, err := b.WithNoMemoryLogger().Create(t.Name(), 0); err == nil {
+			t.Fatalf("%s: case %d expected an error", t.Name(), i)
+		}
+	}
+}
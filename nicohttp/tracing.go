@@ -0,0 +1,544 @@
+package nicohttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	traceparentHeader string = "traceparent"
+	tracestateHeader string = "tracestate"
+	traceVersion string = "00"
+	flagSampled byte = 0x01
+
+	defaultTraceBatchSize int = 512
+	defaultTraceExportInterval time.Duration = 5 * time.Second
+	defaultTraceExportTimeout time.Duration = 10 * time.Second
+	maxQueuedSpans int = 2048
+)
+
+type spanContextKey struct{}
+
+// SpanKind - role of a span in a trace, values as defined by OpenTelemetry
+type SpanKind int
+
+const (
+	// SpanKindInternal ...
+	SpanKindInternal SpanKind = 1
+	// SpanKindServer - incoming request
+	SpanKindServer SpanKind = 2
+	// SpanKindClient - outgoing request
+	SpanKindClient SpanKind = 3
+)
+
+// Span - a timed operation in a distributed trace
+type Span struct {
+	TraceID string
+	SpanID string
+	ParentSpanID string
+	TraceFlags byte
+	TraceState string
+	Name string
+	Kind SpanKind
+	Start time.Time
+	End time.Time
+	Attributes map[string]interface{}
+	Error bool
+
+	mu sync.Mutex
+	tracer *tracer
+	ended bool
+}
+
+// SpanExporter - receives finished, sampled spans in batches
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+	Shutdown(ctx context.Context) error
+}
+
+type tracer struct {
+	svcName string
+	exporter SpanExporter
+	mu sync.Mutex
+	batch []*Span
+	dropped int
+	stop chan struct{}
+	done chan struct{}
+}
+
+
+/**************** Span API **********************/
+
+// SpanFromContext - the current span, nil if the request is not traced
+func SpanFromContext(ctx context.Context) (*Span) {
+	s, _ := ctx.Value(spanContextKey{}).(*Span)
+	return s
+}
+
+
+// ContextWithSpan - returns a copy of ctx carrying span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+
+// StartSpan - starts a child span of the span in ctx, e.g. around a database call in a handler.
+// Returns ctx unchanged and a nil span if ctx is not traced
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.tracer.newSpan(name, kind, parent.TraceID, parent.SpanID, parent.TraceFlags, parent.TraceState)
+	return ContextWithSpan(ctx, s), s
+}
+
+
+// SetAttribute - records an attribute on the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Attributes[key] = value
+	s.mu.Unlock()
+}
+
+
+// SetError - marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Error = true
+	s.Attributes["error.message"] = err.Error()
+	s.mu.Unlock()
+}
+
+
+// Finish - ends the span and queues it for export when sampled
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	if s.Sampled() && s.tracer != nil {
+		s.tracer.enqueue(s)
+	}
+}
+
+
+// Sampled - true if the sampled trace flag is set
+func (s *Span) Sampled() bool {
+	return s.TraceFlags&flagSampled == flagSampled
+}
+
+
+// Traceparent - W3C traceparent header value identifying this span as the parent
+func (s *Span) Traceparent() string {
+	return fmt.Sprintf("%s-%s-%s-%02x", traceVersion, s.TraceID, s.SpanID, s.TraceFlags)
+}
+
+
+/**************** W3C trace context **********************/
+
+// parseTraceparent - trace ID, parent span ID and flags of a W3C traceparent header
+func parseTraceparent(h string) (traceID string, parentID string, flags byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", 0, false
+	}
+	/* version 00 has exactly 4 fields, later versions may append more */
+	if parts[0] == traceVersion && len(parts) != 4 {
+		return "", "", 0, false
+	}
+	if !isLowerHex(parts[1], 32) || !isLowerHex(parts[2], 16) || !isLowerHex(parts[3], 2) {
+		return "", "", 0, false
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return "", "", 0, false
+	}
+	f, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return "", "", 0, false
+	}
+	return parts[1], parts[2], byte(f), true
+}
+
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		/* all zero IDs are invalid */
+		if !bytes.Equal(b, make([]byte, n)) {
+			return hex.EncodeToString(b)
+		}
+	}
+}
+
+
+/**************** Tracer **********************/
+
+func newTracer(svcName string, exporter SpanExporter) (*tracer) {
+	return &tracer{svcName: svcName, exporter: exporter}
+}
+
+
+func (t *tracer) newSpan(name string, kind SpanKind, traceID, parentID string, flags byte, state string) (*Span) {
+	if traceID == "" {
+		traceID = randomHex(16)
+		flags = flagSampled
+	}
+	return &Span{
+		TraceID: traceID,
+		SpanID: randomHex(8),
+		ParentSpanID: parentID,
+		TraceFlags: flags,
+		TraceState: state,
+		Name: name,
+		Kind: kind,
+		Start: time.Now(),
+		Attributes: make(map[string]interface{}),
+		tracer: t,
+	}
+}
+
+
+func (t *tracer) start() {
+	if t.exporter == nil {
+		return
+	}
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(defaultTraceExportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+				case <-ticker.C:
+					t.export(context.Background())
+				case <-t.stop:
+					return
+			}
+		}
+	}()
+}
+
+
+func (t *tracer) enqueue(s *Span) {
+	if t.exporter == nil {
+		return
+	}
+	t.mu.Lock()
+	if len(t.batch) >= maxQueuedSpans {
+		t.dropped++
+		t.mu.Unlock()
+		return
+	}
+	t.batch = append(t.batch, s)
+	full := len(t.batch) >= defaultTraceBatchSize
+	t.mu.Unlock()
+	if full {
+		go t.export(context.Background())
+	}
+}
+
+
+func (t *tracer) export(ctx context.Context) error {
+	t.mu.Lock()
+	batch := t.batch
+	t.batch = nil
+	t.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, defaultTraceExportTimeout)
+	defer cancel()
+	err := t.exporter.ExportSpans(ctx, batch)
+	if err != nil {
+		fmt.Printf("Span export for service %s failed: spans=%d, error=%s\n", t.svcName, len(batch), err)
+	}
+	return err
+}
+
+
+// shutdown - exports the remaining spans and shuts the exporter down
+func (t *tracer) shutdown(ctx context.Context) error {
+	if t.exporter == nil {
+		return nil
+	}
+	if t.stop != nil {
+		close(t.stop)
+		<-t.done
+		t.stop = nil
+	}
+	err := t.export(ctx)
+	if serr := t.exporter.Shutdown(ctx); err == nil {
+		err = serr
+	}
+	return err
+}
+
+
+/**************** Exporters **********************/
+
+// InMemoryExporter - keeps exported spans in memory, intended for tests
+type InMemoryExporter struct {
+	mu sync.Mutex
+	spans []*Span
+}
+
+
+// NewInMemoryExporter - returns an empty InMemoryExporter
+func NewInMemoryExporter() (*InMemoryExporter) {
+	return &InMemoryExporter{}
+}
+
+
+// ExportSpans - SpanExporter implementation
+func (e *InMemoryExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	e.mu.Lock()
+	e.spans = append(e.spans, spans...)
+	e.mu.Unlock()
+	return nil
+}
+
+
+// Shutdown - SpanExporter implementation
+func (e *InMemoryExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+
+// Spans - the spans exported so far
+func (e *InMemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span{}, e.spans...)
+}
+
+
+// Reset - discards the spans exported so far
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	e.spans = nil
+	e.mu.Unlock()
+}
+
+
+// OTLPHTTPExporter - exports spans to an OpenTelemetry collector using OTLP/HTTP with JSON encoding
+type OTLPHTTPExporter struct {
+	endpoint string
+	headers map[string]string
+	svcName string
+	client *http.Client
+}
+
+
+// NewOTLPHTTPExporter - exporter posting to endpoint, e.g. http://otel-collector:4318/v1/traces.
+// headers are added to every export request, e.g. for collector authentication
+func NewOTLPHTTPExporter(endpoint string, headers map[string]string) (*OTLPHTTPExporter) {
+	return &OTLPHTTPExporter{endpoint: endpoint, headers: headers, client: &http.Client{Timeout: defaultTraceExportTimeout}}
+}
+
+
+type otlpKeyValue struct {
+	Key string `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID string `json:"traceId"`
+	SpanID string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId,omitempty"`
+	TraceState string `json:"traceState,omitempty"`
+	Name string `json:"name"`
+	Kind int `json:"kind"`
+	StartTimeUnixNano string `json:"startTimeUnixNano"`
+	EndTimeUnixNano string `json:"endTimeUnixNano"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	Status map[string]int `json:"status"`
+}
+
+
+// ExportSpans - SpanExporter implementation
+func (e *OTLPHTTPExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	js, err := json.Marshal(e.payload(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP export to %s failed with status %d", e.endpoint, resp.StatusCode)
+	}
+	return nil
+}
+
+
+// Shutdown - SpanExporter implementation
+func (e *OTLPHTTPExporter) Shutdown(ctx context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+
+func (e *OTLPHTTPExporter) payload(spans []*Span) map[string]interface{} {
+	svcName := e.svcName
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		if svcName == "" && s.tracer != nil {
+			svcName = s.tracer.svcName
+		}
+		s.mu.Lock()
+		ospan := otlpSpan{
+			TraceID: s.TraceID,
+			SpanID: s.SpanID,
+			ParentSpanID: s.ParentSpanID,
+			TraceState: s.TraceState,
+			Name: s.Name,
+			Kind: int(s.Kind),
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano: strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes: otlpAttributes(s.Attributes),
+			Status: map[string]int{"code": 1},
+		}
+		if s.Error {
+			ospan.Status["code"] = 2
+		}
+		s.mu.Unlock()
+		out = append(out, ospan)
+	}
+	resource := map[string]interface{}{
+		"attributes": []otlpKeyValue{{Key: "service.name", Value: map[string]interface{}{"stringValue": svcName}}},
+	}
+	scope := map[string]interface{}{
+		"scope": map[string]string{"name": "nicohttp"},
+		"spans": out,
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{"resource": resource, "scopeSpans": []interface{}{scope}},
+		},
+	}
+}
+
+
+func otlpAttributes(attrs map[string]interface{}) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch tv := v.(type) {
+			case string:
+				value = map[string]interface{}{"stringValue": tv}
+			case bool:
+				value = map[string]interface{}{"boolValue": tv}
+			case int:
+				value = map[string]interface{}{"intValue": strconv.Itoa(tv)}
+			case int64:
+				value = map[string]interface{}{"intValue": strconv.FormatInt(tv, 10)}
+			case float64:
+				value = map[string]interface{}{"doubleValue": tv}
+			default:
+				value = map[string]interface{}{"stringValue": fmt.Sprint(tv)}
+		}
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: value})
+	}
+	return kvs
+}
+
+
+/**************** Mediator **********************/
+
+func (h *NicoServer) tracingMediator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+			r.Header.Set(requestIDHeader, requestID)
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		ctx := ContextWithRequestID(r.Context(), requestID)
+
+		/* the span carries the trace to handlers and outgoing calls even without an exporter,
+		   Finish then only drops it */
+		t := h.tracer
+		traceID, parentID, flags, ok := parseTraceparent(r.Header.Get(traceparentHeader))
+		state := ""
+		if ok {
+			state = r.Header.Get(tracestateHeader)
+		} else {
+			traceID, parentID, flags = "", "", 0
+		}
+		route := routeName(h.httpRouter, r)
+		name := r.Method
+		if route != "" {
+			name = fmt.Sprintf("%s %s", r.Method, route)
+		}
+		span := t.newSpan(name, SpanKindServer, traceID, parentID, flags, state)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.request_id", requestID)
+
+		sw := statusResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(&sw, r.WithContext(ContextWithSpan(ctx, span)))
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttribute("http.status_code", status)
+		span.SetAttribute("enduser.id", authenticatedUser(r))
+		if status >= http.StatusInternalServerError {
+			span.SetError(errors.New(http.StatusText(status)))
+		}
+		span.Finish()
+	})
+}
@@ -0,0 +1,156 @@
+package nicohttp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+
+func TestParseTraceparent(t *testing.T) {
+	valid := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	traceID, parentID, flags, ok := parseTraceparent(valid)
+	if !ok || traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || parentID != "00f067aa0ba902b7" || flags != flagSampled {
+		t.Fatalf("%s: failed to parse %s", t.Name(), valid)
+	}
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	}
+	for _, h := range invalid {
+		if _, _, _, ok := parseTraceparent(h); ok {
+			t.Fatalf("%s: %q must be rejected", t.Name(), h)
+		}
+	}
+}
+
+
+func TestTracingMediatorPropagation(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	b := GetBuilder().WithDefaults().WithTraceExporter(exporter)
+
+	var handlerSpan *Span
+	h := b.server.tracingMediator(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerSpan = SpanFromContext(r.Context())
+		_, child := StartSpan(r.Context(), "db.query", SpanKindClient)
+		child.Finish()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/regions", nil)
+	req.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set(tracestateHeader, "vendor=abc")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if handlerSpan == nil {
+		t.Fatalf("%s: no span on the handler context", t.Name())
+	}
+	if err := b.server.tracer.export(context.Background()); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	spans := exporter.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("%s: expected 2 exported spans, actual = %d", t.Name(), len(spans))
+	}
+	child, server := spans[0], spans[1]
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" || server.TraceState != "vendor=abc" {
+		t.Fatalf("%s: trace context not propagated: %+v", t.Name(), server)
+	}
+	if child.TraceID != server.TraceID || child.ParentSpanID != server.SpanID {
+		t.Fatalf("%s: child span not parented by the server span", t.Name())
+	}
+	if !server.Error || server.Attributes["http.status_code"] != http.StatusBadGateway {
+		t.Fatalf("%s: status not recorded: %v", t.Name(), server.Attributes)
+	}
+}
+
+
+func TestTracingMediatorNewTrace(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	b := GetBuilder().WithDefaults().WithTraceExporter(exporter)
+
+	h := b.server.tracingMediator(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodGet, "/regions", nil)
+	req.Header.Set(traceparentHeader, "garbage")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	b.server.tracer.export(context.Background())
+
+	spans := exporter.Spans()
+	if len(spans) != 1 || spans[0].ParentSpanID != "" || !isLowerHex(spans[0].TraceID, 32) || !spans[0].Sampled() {
+		t.Fatalf("%s: expected a new sampled root span, actual = %+v", t.Name(), spans)
+	}
+}
+
+
+func TestOTLPHTTPExporter(t *testing.T) {
+	var body map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != applicationJSON || r.Header.Get("X-Collector-Key") != "k" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer collector.Close()
+
+	tr := newTracer(t.Name(), NewOTLPHTTPExporter(collector.URL+"/v1/traces", map[string]string{"X-Collector-Key": "k"}))
+	span := tr.newSpan("GET /regions", SpanKindServer, "", "", 0, "")
+	span.SetAttribute("http.status_code", 200)
+	span.Finish()
+	if err := tr.shutdown(context.Background()); err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	rs, ok := body["resourceSpans"].([]interface{})
+	if !ok || len(rs) != 1 {
+		t.Fatalf("%s: unexpected OTLP payload %v", t.Name(), body)
+	}
+	scopeSpans := rs[0].(map[string]interface{})["scopeSpans"].([]interface{})
+	spans := scopeSpans[0].(map[string]interface{})["spans"].([]interface{})
+	if len(spans) != 1 || spans[0].(map[string]interface{})["traceId"] != span.TraceID {
+		t.Fatalf("%s: unexpected OTLP spans %v", t.Name(), spans)
+	}
+}
+
+
+func TestTracingMediatorWithoutExporter(t *testing.T) {
+	b := GetBuilder().WithDefaults()
+	var downstream string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downstream = r.Header.Get(traceparentHeader)
+	}))
+	defer ts.Close()
+	client := b.server.NewClient()
+
+	var span *Span
+	var requestID string
+	h := b.server.tracingMediator(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span = SpanFromContext(r.Context())
+		requestID = RequestID(r.Context())
+		req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, ts.URL, nil)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/regions", nil)
+	req.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	/* the trace continues to handlers and downstream, only the export is skipped */
+	if span == nil || span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentSpanID != "00f067aa0ba902b7" {
+		t.Fatalf("%s: incoming trace not continued: %+v", t.Name(), span)
+	}
+	if !strings.HasPrefix(downstream, "00-4bf92f3577b34da6a3ce929d0e0e4736-") {
+		t.Fatalf("%s: traceparent %q sent downstream", t.Name(), downstream)
+	}
+	if requestID == "" || rec.Header().Get(requestIDHeader) != requestID {
+		t.Fatalf("%s: request ID %q not propagated, response has %q", t.Name(), requestID, rec.Header().Get(requestIDHeader))
+	}
+}
@@ -0,0 +1,301 @@
+package nicohttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	/* environment of the new process: the file descriptor of the listening socket of each service,
+	   the pipe it reports ready on, and the pipe closed once the upgraded process exits */
+	upgradeListenFDsEnv string = "NICOHTTP_LISTEN_FDS"
+	upgradeReadyFDEnv string = "NICOHTTP_READY_FD"
+	upgradeParentFDEnv string = "NICOHTTP_PARENT_FD"
+	/* ExtraFiles of the new process start at 3 */
+	upgradeFirstFD int = 3
+)
+
+var errUpgradeInProgress = errors.New("upgrade already in progress")
+
+// upgradeCommand - the binary an upgrade starts and its arguments, the executable of the process
+// with its arguments unless a test replaces it
+var upgradeCommand = func() (string, []string, error) {
+	exe, err := os.Executable()
+	return exe, os.Args[1:], err
+}
+
+// upgrades - the servers of the process an upgrade hands off together and, in a process started
+// by an upgrade, the sockets it inherited
+var upgrades = struct {
+	mu sync.Mutex
+	servers []*NicoServer
+	inProgress bool
+	/* write end of the pipe telling the new process this one exited, open until it does */
+	parentExit *os.File
+
+	loadOnce sync.Once
+	inherited map[string]int
+	pending int
+	readyFD int
+	parentExited chan struct{}
+}{}
+
+
+// WithUpgrade - zero downtime upgrades on SIGHUP or POST /upgrade: the binary of the process, by
+// then replaced with the new version, is started with the listening sockets of the servers using
+// WithUpgrade, and once it reports ready within readyTimeout they drain through the normal
+// shutdown. -upgradeTimeout overrides, 0 disables upgrades
+func (b *NicoBuilder) WithUpgrade(readyTimeout time.Duration) (*NicoBuilder) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	b.setDuration(UpgradeTimeoutKey, readyTimeout)
+	return b
+}
+
+
+func configureUpgrade(b *NicoBuilder) {
+	b.server.upgradeTimeout = b.durationProp(UpgradeTimeoutKey, "upgradeTimeout")
+}
+
+
+func (h *NicoServer) upgrade(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("API driven upgrade triggered for service: %s\n", h.svcName)
+	if err := h.handOff(); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUpgradeInProgress) {
+			status = http.StatusConflict
+		}
+		WriteProblem(w, r, status, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+
+// registerUpgradeServer - the listening server is handed off by the next upgrade of the process
+func registerUpgradeServer(h *NicoServer) {
+	defer upgrades.mu.Unlock()
+	upgrades.mu.Lock()
+	upgrades.servers = append(upgrades.servers, h)
+}
+
+
+// unregisterUpgradeServer - the draining server is left out of upgrades
+func unregisterUpgradeServer(h *NicoServer) {
+	defer upgrades.mu.Unlock()
+	upgrades.mu.Lock()
+	for i, s := range upgrades.servers {
+		if s == h {
+			upgrades.servers = append(upgrades.servers[:i], upgrades.servers[i+1:]...)
+			return
+		}
+	}
+}
+
+
+// handOff - starts the new process with the listening sockets of all the servers using
+// WithUpgrade, named by service, and waits for it to report ready, then has their Run drain. The
+// new process is killed if it does not report ready in time
+func (h *NicoServer) handOff() error {
+	upgrades.mu.Lock()
+	if upgrades.inProgress {
+		upgrades.mu.Unlock()
+		return errUpgradeInProgress
+	}
+	upgrades.inProgress = true
+	servers := append([]*NicoServer(nil), upgrades.servers...)
+	upgrades.mu.Unlock()
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			upgrades.mu.Lock()
+			upgrades.inProgress = false
+			upgrades.mu.Unlock()
+		}
+	}()
+
+	fds := url.Values{}
+	var files []*os.File
+	var listeners []net.Listener
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, s := range servers {
+		if _, ok := fds[s.svcName]; ok {
+			return fmt.Errorf("two servers named %s cannot be handed off", s.svcName)
+		}
+		s.builder.mu.Lock()
+		l := s.listener
+		s.builder.mu.Unlock()
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener %T of service %s cannot be handed off", l, s.svcName)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		fds.Set(s.svcName, strconv.Itoa(upgradeFirstFD + len(files)))
+		files = append(files, f)
+		listeners = append(listeners, l)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	exitR, exitW, err := os.Pipe()
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+
+	exe, args, err := upgradeCommand()
+	if err != nil {
+		readyW.Close()
+		exitR.Close()
+		exitW.Close()
+		return err
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), upgradeListenFDsEnv + "=" + fds.Encode(),
+		upgradeReadyFDEnv + "=" + strconv.Itoa(upgradeFirstFD + len(files)),
+		upgradeParentFDEnv + "=" + strconv.Itoa(upgradeFirstFD + len(files) + 1))
+	cmd.ExtraFiles = append(append([]*os.File{}, files...), readyW, exitR)
+	err = cmd.Start()
+	for _, l := range listeners {
+		restoreNonblock(l)
+	}
+	/* only the new process may hold the write end, so its exit ends the wait below */
+	readyW.Close()
+	exitR.Close()
+	if err != nil {
+		exitW.Close()
+		return err
+	}
+	go cmd.Wait()
+
+	readyR.SetReadDeadline(time.Now().Add(h.upgradeTimeout))
+	if _, err := readyR.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		exitW.Close()
+		return fmt.Errorf("process %d did not report ready within %s: %w", cmd.Process.Pid, h.upgradeTimeout, err)
+	}
+	upgrades.mu.Lock()
+	upgrades.parentExit = exitW
+	upgrades.mu.Unlock()
+	handedOff = true
+	for i, s := range servers {
+		/* the socket path now belongs to the new process */
+		if ul, ok := listeners[i].(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		s.logger.Printf("Service %s upgraded to process %d\n", s.svcName, cmd.Process.Pid)
+		close(s.upgraded)
+	}
+	return nil
+}
+
+
+// loadUpgrade - reads, once, the sockets and pipes handed to the process by an upgrade, and clears
+// them from the environment so the processes it starts do not inherit them
+func loadUpgrade() {
+	upgrades.loadOnce.Do(func() {
+		fds, err := url.ParseQuery(os.Getenv(upgradeListenFDsEnv))
+		readyFD, rerr := strconv.Atoi(os.Getenv(upgradeReadyFDEnv))
+		parentFD, perr := strconv.Atoi(os.Getenv(upgradeParentFDEnv))
+		os.Unsetenv(upgradeListenFDsEnv)
+		os.Unsetenv(upgradeReadyFDEnv)
+		os.Unsetenv(upgradeParentFDEnv)
+		if err != nil || rerr != nil || perr != nil || len(fds) == 0 {
+			return
+		}
+		upgrades.inherited = make(map[string]int)
+		for name := range fds {
+			if fd, err := strconv.Atoi(fds.Get(name)); err == nil {
+				upgrades.inherited[name] = fd
+			}
+		}
+		upgrades.pending = len(upgrades.inherited)
+		upgrades.readyFD = readyFD
+		upgrades.parentExited = make(chan struct{})
+		go func() {
+			/* reads EOF once the upgraded process, holding the write end, has exited */
+			parent := os.NewFile(uintptr(parentFD), "nicohttp-parent")
+			io.Copy(io.Discard, parent)
+			parent.Close()
+			close(upgrades.parentExited)
+		}()
+	})
+}
+
+
+// upgradeInherits - true if the process was started by an upgrade that handed it the listening
+// socket of the service
+func upgradeInherits(svcName string) bool {
+	loadUpgrade()
+	defer upgrades.mu.Unlock()
+	upgrades.mu.Lock()
+	_, ok := upgrades.inherited[svcName]
+	return ok
+}
+
+
+// upgradeParentExited - closed once the process that upgraded this one has exited
+func upgradeParentExited() <-chan struct{} {
+	loadUpgrade()
+	return upgrades.parentExited
+}
+
+
+// inheritedListener - the listening socket of the service handed off by the process being upgraded
+func inheritedListener(svcName string) (net.Listener, error) {
+	upgrades.mu.Lock()
+	fd, ok := upgrades.inherited[svcName]
+	upgrades.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("upgrade: no socket handed off for service %s", svcName)
+	}
+	f := os.NewFile(uintptr(fd), "nicohttp-listener-" + svcName)
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(true)
+	}
+	return l, nil
+}
+
+
+// upgradeServerReady - reports ready to the process being upgraded once every service it handed
+// off is ready, which then drains
+func upgradeServerReady(h *NicoServer) {
+	if !h.inherited {
+		return
+	}
+	upgrades.mu.Lock()
+	upgrades.pending--
+	pending := upgrades.pending
+	upgrades.mu.Unlock()
+	if pending > 0 {
+		return
+	}
+	f := os.NewFile(uintptr(upgrades.readyFD), "nicohttp-ready")
+	f.Write([]byte{1})
+	f.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package nicohttp
+
+import (
+	"net"
+)
+
+
+func restoreNonblock(l net.Listener) {
+}
@@ -0,0 +1,171 @@
+package nicohttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+
+func newUpgradeTestServer(t *testing.T, svcName string, l net.Listener) *NicoServer {
+	b := GetBuilder().WithDefaults().WithNoMemoryLogger().WithoutStdLog().WithUpgrade(10 * time.Second)
+	var srv *NicoServer
+	var err error
+	if l != nil {
+		srv, err = b.CreateWithListener(svcName, l)
+	} else {
+		srv, err = b.Create(svcName, 0)
+	}
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	srv.Mux().HandleFunc("/pid", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, os.Getpid())
+	})
+	return srv
+}
+
+
+func getPid(t *testing.T, port uint32) int {
+	resp, err := http.Get(getTarget(port, "/pid"))
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	pid, err := strconv.Atoi(string(body))
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	return pid
+}
+
+
+func TestUpgrade(t *testing.T) {
+	/* two services in the process, each handed its own socket */
+	svcNames := []string{t.Name(), t.Name() + "-admin"}
+	if os.Getenv(upgradeListenFDsEnv) != "" {
+		/* the upgraded process, serving until the test shuts it down */
+		ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+		defer cancel()
+		done := make(chan error, len(svcNames))
+		for _, name := range svcNames {
+			srv := newUpgradeTestServer(t, name, nil)
+			go func() {
+				done <- srv.Run(ctx)
+			}()
+		}
+		for range svcNames {
+			<-done
+		}
+		return
+	}
+	defer func(cmd func() (string, []string, error)) { upgradeCommand = cmd }(upgradeCommand)
+	defer func() {
+		/* the process lives on after its upgrade, unlike a service */
+		upgrades.mu.Lock()
+		upgrades.inProgress = false
+		upgrades.parentExit.Close()
+		upgrades.parentExit = nil
+		upgrades.mu.Unlock()
+	}()
+	upgradeCommand = func() (string, []string, error) {
+		exe, err := os.Executable()
+		return exe, []string{"-test.run=^TestUpgrade$"}, err
+	}
+
+	var ports []uint32
+	done := make(chan error, len(svcNames))
+	for _, name := range svcNames {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("%s: %s", t.Name(), err)
+		}
+		srv := newUpgradeTestServer(t, name, l)
+		go func() {
+			done <- srv.Run(context.Background())
+		}()
+		<-srv.Ready()
+		ports = append(ports, srv.Port())
+		if pid := getPid(t, srv.Port()); pid != os.Getpid() {
+			t.Fatalf("%s: served by %d, expected %d", t.Name(), pid, os.Getpid())
+		}
+	}
+
+	resp, err := http.Post(getTarget(ports[0], "/upgrade"), "", nil)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("%s: upgrade status %d", t.Name(), resp.StatusCode)
+	}
+	for range svcNames {
+		select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("%s: %s", t.Name(), err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("%s: service did not drain after the upgrade", t.Name())
+		}
+	}
+
+	/* the same ports, now served by the new process */
+	for _, p := range ports {
+		if pid := getPid(t, p); pid == os.Getpid() {
+			t.Fatalf("%s: port %d still served by the upgraded process", t.Name(), p)
+		}
+		resp, err = http.Post(getTarget(p, uriShutdown), "", nil)
+		if err != nil {
+			t.Fatalf("%s: %s", t.Name(), err)
+		}
+		resp.Body.Close()
+	}
+}
+
+
+func TestUpgradeNotReady(t *testing.T) {
+	defer func(cmd func() (string, []string, error)) { upgradeCommand = cmd }(upgradeCommand)
+	upgradeCommand = func() (string, []string, error) {
+		return "/bin/false", nil, nil
+	}
+	if _, err := os.Stat("/bin/false"); err != nil {
+		t.Skipf("%s: %s", t.Name(), err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	srv := newUpgradeTestServer(t, t.Name(), l)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(ctx)
+	}()
+	<-srv.Ready()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	resp, err := http.Post(getTarget(srv.Port(), "/upgrade"), "", nil)
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("%s: upgrade status %d, expected 500", t.Name(), resp.StatusCode)
+	}
+	/* a failed upgrade keeps the service serving */
+	if pid := getPid(t, srv.Port()); pid != os.Getpid() {
+		t.Fatalf("%s: served by %d, expected %d", t.Name(), pid, os.Getpid())
+	}
+}
@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package nicohttp
+
+import (
+	"net"
+	"syscall"
+)
+
+
+// restoreNonblock - puts the socket of l back in non-blocking mode once its file was passed to a
+// new process, which sets the file, sharing the mode with l, blocking. A blocking accept would
+// keep Close from returning
+func restoreNonblock(l net.Listener) {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return
+	}
+	if rc, err := sc.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) {
+			syscall.SetNonblock(int(fd), true)
+		})
+	}
+}